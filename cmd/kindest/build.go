@@ -1,10 +1,14 @@
 package main
 
 import (
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/Jeffail/tunny"
+	"github.com/docker/docker/client"
 	"github.com/midcontinentcontrols/kindest/pkg/kindest"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -17,16 +21,38 @@ var buildCmd = &cobra.Command{
 	Short: "",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		start := time.Now()
+		// Cancel on Ctrl-C / SIGTERM so a Build in flight (and the
+		// tunny-pooled dependency builds alongside it) stop at the next
+		// context check instead of running to completion regardless.
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		// Only the default/docker builder needs a Docker daemon at all, so
+		// CI machines with no dockerd reachable can still `kindest build
+		// --builder=buildah`.
+		var cli client.APIClient
+		if buildArgs.Builder == "" || buildArgs.Builder == "docker" {
+			var err error
+			cli, err = client.NewEnvClient()
+			if err != nil {
+				return err
+			}
+		}
 		var pool *tunny.Pool
 		pool = tunny.NewFunc(buildArgs.Concurrency, func(payload interface{}) interface{} {
+			job := payload.(*kindest.BuildJob)
 			return kindest.BuildEx(
-				payload.(*kindest.BuildOptions),
+				job.Context,
+				job.Options,
+				cli,
 				pool,
 				nil,
 			)
 		})
 		defer pool.Close()
-		err, _ := pool.Process(&buildArgs).(error)
+		err, _ := pool.Process(&kindest.BuildJob{
+			Context: ctx,
+			Options: &buildArgs,
+		}).(error)
 		if err != nil {
 			return err
 		}
@@ -41,6 +67,8 @@ func init() {
 	buildCmd.PersistentFlags().StringVarP(&buildArgs.Tag, "tag", "t", "latest", "docker image tag")
 	buildCmd.PersistentFlags().BoolVar(&buildArgs.NoCache, "no-cache", false, "build images from scratch")
 	buildCmd.PersistentFlags().BoolVar(&buildArgs.Squash, "squash", false, "squashes newly built layers into a single new layer (docker experimental feature)")
+	buildCmd.PersistentFlags().StringVar(&buildArgs.Builder, "builder", "docker", "container build backend to use: docker, buildah, or buildkit")
+	buildCmd.PersistentFlags().BoolVar(&buildArgs.NoBuildCache, "no-build-cache", false, "don't retag an already-built image from ~/.kindest/cache/builds.json, even if its content digest matches")
 	//buildCmd.PersistentFlags().BoolVarP(&buildArgs.Push, "push", "p", false, "push all built images")
 	buildCmd.PersistentFlags().IntVarP(&buildArgs.Concurrency, "concurrency", "c", runtime.NumCPU(), "number of parallel build jobs (defaults to num cpus)")
 }
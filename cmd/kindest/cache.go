@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/docker/docker/client"
+	"github.com/midcontinentcontrols/kindest/pkg/kindest"
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect or evict the local build cache",
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Evict every entry from ~/.kindest/cache/builds.json",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return kindest.CleanBuildCache()
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Evict build cache entries whose image no longer exists locally",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cli, err := client.NewEnvClient()
+		if err != nil {
+			return err
+		}
+		return kindest.PruneBuildCache(cli)
+	},
+}
+
+func init() {
+	ConfigureCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheCleanCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+}
@@ -2,25 +2,20 @@ package kindest
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/Jeffail/tunny"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/jsonmessage"
-	"github.com/docker/docker/pkg/term"
-	"github.com/google/uuid"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/hashicorp/go-multierror"
-	"github.com/jhoonb/archivex"
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
 )
@@ -30,10 +25,27 @@ type DockerBuildArg struct {
 	Value string `json:"value"`
 }
 
+// BuildSecret declares a build-time secret mount made available to
+// `RUN --mount=type=secret,id=<ID>` instructions by the buildkit backend.
+type BuildSecret struct {
+	ID  string `json:"id"`
+	Src string `json:"src"`
+}
+
+// BuildSSH declares an SSH agent socket or key forwarded to
+// `RUN --mount=type=ssh,id=<ID>` instructions by the buildkit backend.
+type BuildSSH struct {
+	ID    string   `json:"id"`
+	Paths []string `json:"paths,omitempty"`
+}
+
 type DockerBuildSpec struct {
 	Dockerfile string            `json:"dockerfile"`
 	Context    string            `json:"context,omitempty"`
 	BuildArgs  []*DockerBuildArg `json:"buildArgs,omitempty"`
+	Target     string            `json:"target,omitempty"`
+	Secrets    []*BuildSecret    `json:"secrets,omitempty"`
+	SSH        []*BuildSSH       `json:"ssh,omitempty"`
 }
 
 type BuildSpec struct {
@@ -72,22 +84,41 @@ func (b *BuildSpec) Verify(manifestPath string) error {
 }
 
 func (b *BuildSpec) Build(
+	ctx context.Context,
 	manifestPath string,
 	options *BuildOptions,
 	cli client.APIClient,
 	respHandler func(io.ReadCloser) error,
 ) error {
 	docker := b.Docker
-	contextPath := filepath.Clean(filepath.Join(filepath.Dir(manifestPath), docker.Context))
-	u, err := user.Current()
+	if options.Builder == "buildkit" {
+		tag := options.Tag
+		if tag == "" {
+			tag = "latest"
+		}
+		return buildWithBuildKit(ctx, manifestPath, b, options, fmt.Sprintf("%s:%s", b.Name, tag))
+	}
+	if options.Builder == "native" {
+		tag := options.Tag
+		if tag == "" {
+			tag = "latest"
+		}
+		return buildNative(ctx, manifestPath, b, options, fmt.Sprintf("%s:%s", b.Name, tag))
+	}
+	builder, err := builderFor(options, cli)
 	if err != nil {
 		return err
 	}
-	tmpDir := filepath.Join(u.HomeDir, ".kindest", "tmp")
-	if err := os.MkdirAll(tmpDir, 0766); err != nil {
-		return err
+	var contextPath string
+	if isRemoteContext(docker.Context) {
+		resolved, err := resolveRemoteContext(ctx, docker.Context, options)
+		if err != nil {
+			return fmt.Errorf("failed to fetch remote build context: %v", err)
+		}
+		contextPath = resolved
+	} else {
+		contextPath = filepath.Clean(filepath.Join(filepath.Dir(manifestPath), docker.Context))
 	}
-	ctxPath := filepath.Join(tmpDir, fmt.Sprintf("build-context-%s.tar", uuid.New().String()))
 	tag := options.Tag
 	if tag == "" {
 		tag = "latest"
@@ -95,17 +126,8 @@ func (b *BuildSpec) Build(
 	tag = fmt.Sprintf("%s:%s", b.Name, tag)
 	log.Info("Building",
 		zap.String("tag", tag),
+		zap.String("builder", options.Builder),
 		zap.Bool("noCache", options.NoCache))
-	tar := new(archivex.TarFile)
-	tar.Create(ctxPath)
-	tar.AddAll(contextPath, false)
-	tar.Close()
-	defer os.Remove(ctxPath)
-	dockerBuildContext, err := os.Open(ctxPath)
-	if err != nil {
-		return err
-	}
-	defer dockerBuildContext.Close()
 	buildArgs := make(map[string]*string)
 	for _, arg := range docker.BuildArgs {
 		buildArgs[arg.Name] = &arg.Value
@@ -118,75 +140,118 @@ func (b *BuildSpec) Build(
 	if err != nil {
 		return err
 	}
-	resp, err := cli.ImageBuild(
-		context.TODO(),
-		dockerBuildContext,
-		types.ImageBuildOptions{
-			NoCache:    options.NoCache,
-			Dockerfile: resolvedDockerfile,
-			BuildArgs:  buildArgs,
-			Squash:     options.Squash,
-			Tags:       []string{tag},
-		},
-	)
+	excludes, err := dockerIgnoreExcludes(contextPath, resolvedDockerfile)
 	if err != nil {
 		return err
 	}
-	if respHandler != nil {
-		if err := respHandler(resp.Body); err != nil {
-			return err
+	var cacheKey string
+	if !options.NoBuildCache && cli != nil {
+		if plan, planErr := ResolveManifest(ctx, &BuildOptions{File: manifestPath}, cli); planErr != nil {
+			log.Error("failed to resolve build plan for build cache", zap.String("err", planErr.Error()))
+		} else if tarDigest, tarErr := tarContentDigest(contextPath, excludes); tarErr != nil {
+			return tarErr
+		} else {
+			cacheKey = buildCacheKey(plan.Root.Digest, tarDigest, options.NoCache, options.Squash)
+			if entry, lookupErr := lookupLocalBuildCache(cacheKey); lookupErr != nil {
+				return lookupErr
+			} else if entry != nil {
+				if _, _, err := cli.ImageInspectWithRaw(ctx, entry.ImageID); err == nil {
+					if err := cli.ImageTag(ctx, entry.ImageID, tag); err != nil {
+						return err
+					}
+					log.Info("Build cache hit, skipping build",
+						zap.String("tag", tag),
+						zap.String("imageId", entry.ImageID))
+					emitBuildEvent(options.Events, options.Sink, BuildEvent{
+						Kind:    BuildEventCacheHit,
+						Module:  manifestPath,
+						Image:   tag,
+						Message: fmt.Sprintf("build cache hit (%s)", cacheKey),
+					})
+					return b.pushAndRecord(ctx, manifestPath, options, tag, builder)
+				}
+			}
 		}
-	} else {
-		termFd, isTerm := term.GetFdInfo(os.Stderr)
-		if err := jsonmessage.DisplayJSONMessagesStream(
-			resp.Body,
-			os.Stderr,
-			termFd,
-			isTerm,
-			nil,
-		); err != nil {
-			return err
+	}
+	dockerBuildContext, err := archive.TarWithOptions(contextPath, &archive.TarOptions{
+		ExcludePatterns: excludes,
+	})
+	if err != nil {
+		return err
+	}
+	defer dockerBuildContext.Close()
+	body, err := builder.Build(ctx, BuildRequest{
+		Context:    dockerBuildContext,
+		Dockerfile: resolvedDockerfile,
+		Tag:        tag,
+		BuildArgs:  buildArgs,
+		NoCache:    options.NoCache,
+		Squash:     options.Squash,
+		Target:     docker.Target,
+	})
+	if err != nil {
+		return err
+	}
+	if err := handleBuildOutput(body, options, respHandler); err != nil {
+		return err
+	}
+	if cacheKey != "" {
+		if imageID, err := imageIDForTag(ctx, cli, tag); err != nil {
+			log.Error("failed to inspect built image for build cache", zap.String("err", err.Error()))
+		} else if err := storeLocalBuildCache(cacheKey, imageID, tag); err != nil {
+			log.Error("failed to record build cache entry", zap.String("err", err.Error()))
 		}
 	}
+	return b.pushAndRecord(ctx, manifestPath, options, tag, builder)
+}
+
+// pushAndRecord pushes tag through builder (if options.Push) and updates
+// ~/.kindest/state.json so the next ResolveManifest call sees this module as
+// up to date. It's shared between a fresh build and a build-cache hit, since
+// both end up with the same tag ready to go.
+func (b *BuildSpec) pushAndRecord(
+	ctx context.Context,
+	manifestPath string,
+	options *BuildOptions,
+	tag string,
+	builder Builder,
+) error {
 	if options.Push {
 		log := log.With(zap.String("tag", tag))
 		log.Info("Pushing image")
-		authConfig, err := RegistryAuthFromEnv()
+		emitBuildEvent(options.Events, options.Sink, BuildEvent{Kind: BuildEventPush, Module: manifestPath, Image: tag})
+		authConfig, err := ResolveRegistryAuth(tag)
 		if err != nil {
 			return err
 		}
-		log.Info("Using docker credentials from env", zap.String("username", string(authConfig.Username)))
-		authBytes, err := json.Marshal(authConfig)
+		log.Info("Resolved registry credentials", zap.String("username", string(authConfig.Username)))
+		pushBody, err := builder.Push(ctx, tag, authConfig)
 		if err != nil {
 			return err
 		}
-		registryAuth := base64.URLEncoding.EncodeToString(authBytes)
-		resp, err := cli.ImagePush(
-			context.TODO(),
-			tag,
-			types.ImagePushOptions{
-				All:          false,
-				RegistryAuth: registryAuth,
-			},
-		)
-		if err != nil {
-			return err
-		}
-		termFd, isTerm := term.GetFdInfo(os.Stderr)
-		if err := jsonmessage.DisplayJSONMessagesStream(
-			resp,
-			os.Stderr,
-			termFd,
-			isTerm,
-			nil,
-		); err != nil {
+		if err := handleBuildOutput(pushBody, options, nil); err != nil {
 			return err
 		}
 		log.Info("Pushed image")
 	}
+	if plan, err := ResolveManifest(ctx, &BuildOptions{File: manifestPath}, nil); err != nil {
+		log.Error("failed to resolve build plan for caching", zap.String("err", err.Error()))
+	} else if err := recordBuilt(manifestPath, b.Name, plan.Root.Digest, tag); err != nil {
+		log.Error("failed to record build state", zap.String("err", err.Error()))
+	}
 	return nil
 }
 
+// imageIDForTag inspects tag to get the image ID the backend just built it
+// as, so the build cache can remember exactly what a cache key produced.
+func imageIDForTag(ctx context.Context, cli client.APIClient, tag string) (string, error) {
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, tag)
+	if err != nil {
+		return "", err
+	}
+	return inspect.ID, nil
+}
+
 type BuildOptions struct {
 	File        string `json:"file,omitempty"`
 	NoCache     bool   `json:"nocache,omitempty"`
@@ -194,15 +259,75 @@ type BuildOptions struct {
 	Tag         string `json:"tag,omitempty"`
 	Concurrency int    `json:"concurrency,omitempty"`
 	Push        bool   `json:"push,omitempty"`
+
+	// NoBuildCache disables the local content-addressed build cache
+	// (~/.kindest/cache/builds.json): even when a previous build already
+	// produced an identical image, BuildSpec.Build will invoke the backend
+	// instead of just retagging it.
+	NoBuildCache bool `json:"noBuildCache,omitempty"`
+
+	// Builder selects the backend used to drive the build: "" / "docker"
+	// (the classic Engine API, the default), "buildah" (shells out to
+	// `buildah bud`/`buildah push` to build rootless with no daemon),
+	// "buildkit", or "native" (a pure-Go backend that needs no Docker
+	// daemon at all). cli may be nil unless this is "" / "docker".
+	Builder string `json:"builder,omitempty"`
+
+	// Exporter controls where a buildkit build's result goes: "docker"
+	// (load into the local daemon, the default unless Push is set), "image"
+	// (push straight to the registry, the default when Push is set), or
+	// "oci" (write an OCI tarball to ExporterOutput).
+	Exporter       string `json:"exporter,omitempty"`
+	ExporterOutput string `json:"exporterOutput,omitempty"`
+
+	// Events, if set, receives a BuildEvent for every line of build/push
+	// progress emitted by the selected backend. Sends are non-blocking, so a
+	// caller that isn't actively draining it just misses events rather than
+	// stalling the build.
+	Events chan<- BuildEvent `json:"-"`
+
+	// BuildCache, if set, is consulted before building a Module and updated
+	// after a successful push so that unchanged modules can be retagged
+	// from the registry instead of rebuilt.
+	BuildCache BuildCache `json:"-"`
+
+	// ContextResolver overrides how a remote build.context (git:// or
+	// https://...#ref:subdir) is fetched into a local directory. Tests use
+	// this to inject a fake fetcher instead of hitting the network.
+	ContextResolver func(context string) (string, error) `json:"-"`
+
+	// Sink, if set, receives build/push progress as typed BuildEventSink
+	// calls instead of a raw jsonmessage stream. Defaults to a TTY sink
+	// writing to os.Stderr, kindest's classic behavior; NewJSONLinesSink and
+	// NewChannelSink are ready-made alternatives for CI logs and
+	// programmatic callers respectively.
+	Sink BuildEventSink `json:"-"`
+}
+
+// BuildJob is what Build and buildDependencies dispatch through a
+// tunny.Pool: tunny's worker func is a plain func(interface{}) interface{},
+// so this carries the per-call context.Context alongside the BuildOptions it
+// can't otherwise express in that signature.
+type BuildJob struct {
+	Context context.Context
+	Options *BuildOptions
 }
 
+// buildDependencies builds every dependency of spec concurrently through
+// pool. ctx is derived into a cancelable child so that as soon as one
+// dependency errors, its siblings' BuildEx calls see ctx.Done() and can stop
+// early instead of finishing a build (or push) whose result is just going to
+// be discarded.
 func buildDependencies(
+	ctx context.Context,
 	spec *KindestSpec,
 	manifestPath string,
 	options *BuildOptions,
 	cli client.APIClient,
 	pool *tunny.Pool,
 ) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	n := len(spec.Dependencies)
 	dones := make([]chan error, n, n)
 	rootDir := filepath.Dir(manifestPath)
@@ -213,7 +338,18 @@ func buildDependencies(
 			opts := &BuildOptions{}
 			*opts = *options
 			opts.File = filepath.Clean(filepath.Join(rootDir, dep, "kindest.yaml"))
-			err, _ := pool.Process(opts).(error)
+			if !options.NoCache {
+				if plan, err := ResolveManifest(ctx, opts, cli); err == nil && plan.Root.UpToDate {
+					emitCachedEvent(options.Events, options.Sink, plan.Root)
+					done <- nil
+					close(done)
+					return
+				}
+			}
+			err, _ := pool.Process(&BuildJob{Context: ctx, Options: opts}).(error)
+			if err != nil {
+				cancel()
+			}
 			done <- err
 			close(done)
 		}(dep, done)
@@ -222,6 +358,7 @@ func buildDependencies(
 	for i, done := range dones {
 		if err := <-done; err != nil {
 			multi = multierror.Append(multi, fmt.Errorf("dependency '%s': %v", spec.Dependencies[i], err))
+			cancel()
 		}
 	}
 	return multi
@@ -243,6 +380,24 @@ func locateSpec(file string) (string, error) {
 	return filepath.Join(dir, "kindest.yaml"), nil
 }
 
+// handleBuildOutput decodes a backend's raw JSON message stream once: a
+// caller-supplied respHandler wins for backward compatibility, otherwise it's
+// dispatched to options.Sink (a TTY sink writing to os.Stderr by default,
+// kindest's classic behavior) and forwarded to options.Events if also set.
+// This replaces the old jsonmessage.DisplayJSONMessagesStream-straight-to-
+// stderr pipeline, which gave programmatic callers (CI logs, a future
+// kindest daemon/HTTP API, IDE integrations) nothing but ANSI to scrape.
+func handleBuildOutput(body io.ReadCloser, options *BuildOptions, respHandler func(io.ReadCloser) error) error {
+	if respHandler != nil {
+		return respHandler(body)
+	}
+	sink := options.Sink
+	if sink == nil {
+		sink = NewTTYSink(os.Stderr)
+	}
+	return streamBuildEvents(body, options.Events, sink)
+}
+
 func resolveDockerfile(manifestPath string, dockerfilePath string, contextPath string) (string, error) {
 	rootDir := filepath.Dir(manifestPath)
 	dockerfilePath = filepath.Clean(filepath.Join(rootDir, dockerfilePath))
@@ -284,18 +439,18 @@ func loadSpec(file string) (*KindestSpec, string, error) {
 	return spec, manifestPath, nil
 }
 
-func Build(options *BuildOptions, cli client.APIClient) error {
+func Build(ctx context.Context, options *BuildOptions, cli client.APIClient) error {
 	var pool *tunny.Pool
 	concurrency := options.Concurrency
 	if concurrency == 0 {
 		concurrency = runtime.NumCPU()
 	}
 	pool = tunny.NewFunc(concurrency, func(payload interface{}) interface{} {
-		options := payload.(*BuildOptions)
-		return BuildEx(options, cli, pool, nil)
+		job := payload.(*BuildJob)
+		return BuildEx(job.Context, job.Options, cli, pool, nil)
 	})
 	defer pool.Close()
-	return BuildEx(options, cli, pool, nil)
+	return BuildEx(ctx, options, cli, pool, nil)
 }
 
 func RegistryAuthFromEnv() (*types.AuthConfig, error) {
@@ -313,18 +468,76 @@ func RegistryAuthFromEnv() (*types.AuthConfig, error) {
 	}, nil
 }
 
+// BuildEx builds and (optionally) pushes a single module, regardless of
+// which backend options.Builder selects. Its lifecycle -- Start, CacheHit
+// (emitted by buildDependencies for an up-to-date dependency), Push, Done,
+// and Error -- is reported as a BuildEvent on options.Events if set, and is
+// always logged through the package logger. respHandler is deprecated in
+// favor of options.Events: for the buildkit/native backends (which have no
+// raw daemon stream of their own for it to parse), a caller that only
+// supplies respHandler is bridged onto a synthetic Events channel via
+// replayEventsToRespHandler, so it keeps working exactly as it did against
+// the classic docker backend.
 func BuildEx(
+	ctx context.Context,
 	options *BuildOptions,
 	cli client.APIClient,
 	pool *tunny.Pool,
 	respHandler func(io.ReadCloser) error,
-) error {
+) (err error) {
 	spec, manifestPath, err := loadSpec(options.File)
 	if err != nil {
 		return err
 	}
+	image := spec.Build.Name
+	started := time.Now()
+	needsEventBridge := respHandler != nil && options.Events == nil &&
+		(options.Builder == "buildkit" || options.Builder == "native")
+	if needsEventBridge {
+		bridgedHandler := respHandler
+		events := make(chan BuildEvent, 256)
+		collected := make(chan []BuildEvent, 1)
+		go func() {
+			var all []BuildEvent
+			for event := range events {
+				all = append(all, event)
+			}
+			collected <- all
+		}()
+		newOptions := &BuildOptions{}
+		*newOptions = *options
+		newOptions.Events = events
+		options = newOptions
+		respHandler = nil
+		defer func() {
+			close(events)
+			if replayErr := replayEventsToRespHandler(<-collected, bridgedHandler); replayErr != nil && err == nil {
+				err = replayErr
+			}
+		}()
+	}
+	emitBuildEvent(options.Events, options.Sink, BuildEvent{Kind: BuildEventStart, Module: manifestPath, Image: image})
+	defer func() {
+		if err != nil {
+			emitBuildEvent(options.Events, options.Sink, BuildEvent{
+				Kind:     BuildEventError,
+				Module:   manifestPath,
+				Image:    image,
+				Message:  err.Error(),
+				Duration: time.Since(started),
+			})
+		} else {
+			emitBuildEvent(options.Events, options.Sink, BuildEvent{
+				Kind:     BuildEventDone,
+				Module:   manifestPath,
+				Image:    image,
+				Duration: time.Since(started),
+			})
+		}
+	}()
 	log.Info("Loaded spec", zap.String("path", manifestPath))
 	if err := buildDependencies(
+		ctx,
 		spec,
 		manifestPath,
 		options,
@@ -334,6 +547,7 @@ func BuildEx(
 		return err
 	}
 	if err := spec.Build.Build(
+		ctx,
 		manifestPath,
 		options,
 		cli,
@@ -341,115 +555,10 @@ func BuildEx(
 	); err != nil {
 		return err
 	}
-	docker := spec.Build.Docker
-	contextPath := filepath.Clean(filepath.Join(filepath.Dir(manifestPath), docker.Context))
-	u, err := user.Current()
-	if err != nil {
-		return err
-	}
-	tmpDir := filepath.Join(u.HomeDir, ".kindest", "tmp")
-	if err := os.MkdirAll(tmpDir, 0766); err != nil {
-		return err
-	}
-	ctxPath := filepath.Join(tmpDir, fmt.Sprintf("build-context-%s.tar", uuid.New().String()))
-	tag := "latest"
-	if options.Tag != "" {
-		tag = options.Tag
-	}
-	tag = fmt.Sprintf("%s:%s", spec.Build.Name, tag)
-	log.Info("Building",
-		zap.String("tag", tag),
-		zap.Bool("noCache", options.NoCache))
-	tar := new(archivex.TarFile)
-	tar.Create(ctxPath)
-	tar.AddAll(contextPath, false)
-	tar.Close()
-	defer os.Remove(ctxPath)
-	dockerBuildContext, err := os.Open(ctxPath)
-	if err != nil {
-		return err
-	}
-	defer dockerBuildContext.Close()
-	buildArgs := make(map[string]*string)
-	for _, arg := range docker.BuildArgs {
-		buildArgs[arg.Name] = &arg.Value
-	}
-	resolvedDockerfile, err := resolveDockerfile(
-		manifestPath,
-		spec.Build.Docker.Dockerfile,
-		spec.Build.Docker.Context,
-	)
-	if err != nil {
-		return err
-	}
-	resp, err := cli.ImageBuild(
-		context.TODO(),
-		dockerBuildContext,
-		types.ImageBuildOptions{
-			NoCache:    options.NoCache,
-			Dockerfile: resolvedDockerfile,
-			BuildArgs:  buildArgs,
-			Squash:     options.Squash,
-			Tags:       []string{tag},
-		},
-	)
-	if err != nil {
-		return err
-	}
-	if respHandler != nil {
-		if err := respHandler(resp.Body); err != nil {
-			return err
-		}
-	} else {
-		termFd, isTerm := term.GetFdInfo(os.Stderr)
-		if err := jsonmessage.DisplayJSONMessagesStream(
-			resp.Body,
-			os.Stderr,
-			termFd,
-			isTerm,
-			nil,
-		); err != nil {
-			return err
-		}
-	}
-
-	if options.Push {
-		log := log.With(zap.String("tag", tag))
-		log.Info("Pushing image")
-		authConfig, err := RegistryAuthFromEnv()
-		if err != nil {
-			return err
-		}
-		log.Info("Using docker credentials from env", zap.String("username", string(authConfig.Username)))
-		authBytes, err := json.Marshal(authConfig)
-		if err != nil {
-			return err
-		}
-		registryAuth := base64.URLEncoding.EncodeToString(authBytes)
-		resp, err := cli.ImagePush(
-			context.TODO(),
-			tag,
-			types.ImagePushOptions{
-				All:          false,
-				RegistryAuth: registryAuth,
-			},
-		)
-		if err != nil {
-			return err
-		}
-		termFd, isTerm := term.GetFdInfo(os.Stderr)
-		if err := jsonmessage.DisplayJSONMessagesStream(
-			resp,
-			os.Stderr,
-			termFd,
-			isTerm,
-			nil,
-		); err != nil {
-			return err
-		}
-		log.Info("Pushed image")
-	}
-
+	// BuildSpec.Build already drove the whole build (and push) through
+	// whichever backend options.Builder selected -- docker and buildah via
+	// the Builder interface, buildkit and native through their own
+	// special-cased entry points -- so there's nothing left to do here.
 	return nil
 }
 
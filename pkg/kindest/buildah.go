@@ -0,0 +1,148 @@
+package kindest
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"go.uber.org/zap"
+
+	"github.com/midcontinentcontrols/kindest/pkg/logger"
+)
+
+// untarToDir extracts a tar archive into dir, creating any intermediate
+// directories as needed. It's used to materialize the in-memory build
+// context onto disk for builders (like buildah) that require a context
+// directory rather than a stream.
+func untarToDir(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		path, err := safeJoinTarPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// buildBuildah drives `buildah bud` against a materialized build context,
+// giving rootless hosts without a Docker daemon a local build path. It
+// mirrors buildDocker/buildKaniko's signature and status semantics so it can
+// be dropped into doBuild's Builder switch unchanged.
+func buildBuildah(
+	m *Module,
+	dest string,
+	buildContext []byte,
+	relativeDockerfile string,
+	options *BuildOptions,
+	log logger.Logger,
+) error {
+	contextDir, err := ioutil.TempDir("", "kindest-buildah-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(contextDir)
+	if err := untarToDir(bytes.NewReader(buildContext), contextDir); err != nil {
+		return fmt.Errorf("failed to extract build context: %v", err)
+	}
+	args := []string{
+		"bud",
+		"--file", filepath.Join(contextDir, relativeDockerfile),
+		"--tag", dest,
+	}
+	if options.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if options.Squash {
+		args = append(args, "--squash")
+	}
+	if m.Spec.Build.Target != "" {
+		args = append(args, "--target", m.Spec.Build.Target)
+	}
+	for _, buildArg := range m.Spec.Build.BuildArgs {
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", buildArg.Name, buildArg.Value))
+	}
+	args = append(args, contextDir)
+	cmd := exec.Command("buildah", args...)
+	var captured bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stderr, &captured)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &captured)
+	log.Info("Building with buildah", zap.String("dest", dest))
+	sink := m.eventSink(options)
+	defer close(sink)
+	err = cmd.Run()
+	emitTextEvents(sink, captured.String())
+	if err != nil {
+		return fmt.Errorf("buildah bud: %v", err)
+	}
+	if !options.NoPush {
+		if err := pushBuildah(dest, sink, log); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pushBuildah(dest string, sink chan<- BuildEvent, log logger.Logger) error {
+	authConfig, err := ResolveRegistryAuth(dest)
+	if err != nil {
+		return err
+	}
+	log.Info("Pushing image", zap.String("username", string(authConfig.Username)))
+	authBytes, err := buildahAuthFileJSON(dest, authConfig)
+	if err != nil {
+		return err
+	}
+	authFile, err := ioutil.TempFile("", "kindest-buildah-auth-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(authFile.Name())
+	if _, err := authFile.Write(authBytes); err != nil {
+		return err
+	}
+	if err := authFile.Close(); err != nil {
+		return err
+	}
+	cmd := exec.Command("buildah", "push", "--authfile", authFile.Name(), dest)
+	var captured bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stderr, &captured)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &captured)
+	err = cmd.Run()
+	emitTextEvents(sink, captured.String())
+	if err != nil {
+		return fmt.Errorf("buildah push: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package kindest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/gofrs/flock"
+	"go.uber.org/zap"
+)
+
+// localBuildCacheEntry is what ~/.kindest/cache/builds.json stores for a
+// single build key: the local image it produced, and the tag it was last
+// built under (useful for cache inspection/pruning, not for the lookup
+// itself).
+type localBuildCacheEntry struct {
+	ImageID string `json:"imageId"`
+	Tag     string `json:"tag"`
+}
+
+type localBuildCacheFile struct {
+	Entries map[string]*localBuildCacheEntry `json:"entries"`
+}
+
+func localBuildCachePath() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".kindest", "cache", "builds.json"), nil
+}
+
+// withLocalBuildCache loads ~/.kindest/cache/builds.json (creating it empty
+// if missing), runs fn against it, and writes it back, all under a file lock
+// so concurrent tunny workers building sibling dependencies don't clobber
+// each other's entries.
+func withLocalBuildCache(fn func(*localBuildCacheFile) error) error {
+	path, err := localBuildCachePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	lock := flock.New(path + ".lock")
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock build cache: %v", err)
+	}
+	defer lock.Unlock()
+	cache := &localBuildCacheFile{Entries: map[string]*localBuildCacheEntry{}}
+	if body, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(body, cache); err != nil {
+			return err
+		}
+		if cache.Entries == nil {
+			cache.Entries = map[string]*localBuildCacheEntry{}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := fn(cache); err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+// lookupLocalBuildCache returns the entry previously stored for key, if any.
+func lookupLocalBuildCache(key string) (*localBuildCacheEntry, error) {
+	var found *localBuildCacheEntry
+	err := withLocalBuildCache(func(cache *localBuildCacheFile) error {
+		if entry, ok := cache.Entries[key]; ok {
+			found = entry
+		}
+		return nil
+	})
+	return found, err
+}
+
+// storeLocalBuildCache records that key produced imageID, tagged dest.
+func storeLocalBuildCache(key, imageID, dest string) error {
+	return withLocalBuildCache(func(cache *localBuildCacheFile) error {
+		cache.Entries[key] = &localBuildCacheEntry{ImageID: imageID, Tag: dest}
+		return nil
+	})
+}
+
+// CleanBuildCache empties ~/.kindest/cache/builds.json, so the next build of
+// every key runs the backend instead of retagging a cached image; that build
+// records a fresh entry again unless BuildOptions.NoBuildCache is set.
+func CleanBuildCache() error {
+	return withLocalBuildCache(func(cache *localBuildCacheFile) error {
+		cache.Entries = map[string]*localBuildCacheEntry{}
+		return nil
+	})
+}
+
+// PruneBuildCache drops entries whose imageID no longer exists locally (the
+// image was removed by `docker image rm`/`docker system prune` since it was
+// cached), so a stale entry can't linger forever pointing at nothing.
+func PruneBuildCache(cli client.APIClient) error {
+	return withLocalBuildCache(func(cache *localBuildCacheFile) error {
+		for key, entry := range cache.Entries {
+			if _, _, err := cli.ImageInspectWithRaw(context.Background(), entry.ImageID); err != nil {
+				log.Info("Pruning stale build cache entry", zap.String("tag", entry.Tag), zap.String("imageId", entry.ImageID))
+				delete(cache.Entries, key)
+			}
+		}
+		return nil
+	})
+}
+
+// buildCacheKey folds manifestDigest (BuildPlanNode.Digest, which already
+// covers the resolved Dockerfile, build args, target, and the digests of
+// every dependency) together with tarDigest and the NoCache/Squash flags
+// into the key BuildOptions.NoBuildCache looks up in the local build cache.
+// Two builds with the same key are guaranteed to produce byte-identical
+// images, so the second one can just retag the first's result.
+func buildCacheKey(manifestDigest, tarDigest string, noCache, squash bool) string {
+	h := sha256.New()
+	h.Write([]byte(manifestDigest))
+	h.Write([]byte(tarDigest))
+	fmt.Fprintf(h, "nocache=%v squash=%v", noCache, squash)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tarContentDigest computes a single digest over every file that would be
+// packed into the build context tar (after excludes, the same .dockerignore
+// patterns archive.TarWithOptions is given), the same moby TarSum-style
+// approach: hash sha256(path || mode || uid || gid || size || content) for
+// each entry, sorted by path for a stable order, and fold the per-entry
+// hashes into one running SHA256.
+func tarContentDigest(contextPath string, excludes []string) (string, error) {
+	matcher, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return "", err
+	}
+	var paths []string
+	if err := filepath.Walk(contextPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == contextPath {
+			return nil
+		}
+		rel, err := filepath.Rel(contextPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		matched, err := matcher.Matches(rel)
+		if err != nil {
+			return err
+		}
+		if matched {
+			// Like archive.TarWithOptions, only skip an excluded directory
+			// outright when no "!" pattern could re-include something in it.
+			if info.IsDir() && !matcher.Exclusions() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		paths = append(paths, rel)
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, rel := range paths {
+		entryHash, err := tarEntryDigest(filepath.Join(contextPath, rel), rel)
+		if err != nil {
+			return "", err
+		}
+		h.Write(entryHash)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func tarEntryDigest(fullPath, rel string) ([]byte, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	io.WriteString(h, rel)
+	fmt.Fprintf(h, "%o", info.Mode())
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		fmt.Fprintf(h, "%d:%d", stat.Uid, stat.Gid)
+	}
+	fmt.Fprintf(h, "%d", info.Size())
+	if info.Mode()&os.ModeSymlink != 0 {
+		// A symlink's size is the length of its target string, so two
+		// different targets of equal length would otherwise collide and
+		// leave this digest (and the build cache keyed on it) blind to the
+		// target actually changing.
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		io.WriteString(h, target)
+	} else if info.Mode().IsRegular() {
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,222 @@
+package kindest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// BuildRequest is the backend-agnostic description of a single image build:
+// everything a Builder needs, regardless of whether it drives the Docker
+// Engine API or shells out to a daemonless CLI like buildah.
+type BuildRequest struct {
+	Context    io.Reader
+	Dockerfile string
+	Tag        string
+	BuildArgs  map[string]*string
+	NoCache    bool
+	Squash     bool
+	Target     string
+}
+
+// Builder drives a single image build and (optionally) its push, hiding
+// whatever's behind it -- a Docker daemon, a shelled-out buildah, buildkit --
+// from BuildSpec.Build/BuildEx. The buildkit and native backends have their
+// own special-cased entry points (buildWithBuildKit, buildNative) instead of
+// implementing this interface, since their solve/exec models don't map onto
+// a single ImageBuild-shaped call.
+type Builder interface {
+	Build(ctx context.Context, req BuildRequest) (io.ReadCloser, error)
+	Push(ctx context.Context, tag string, auth *types.AuthConfig) (io.ReadCloser, error)
+}
+
+// builderFor resolves options.Builder to a Builder implementation. cli may be
+// nil when options.Builder is "buildah", which needs no Docker daemon at all.
+func builderFor(options *BuildOptions, cli client.APIClient) (Builder, error) {
+	switch options.Builder {
+	case "", "docker":
+		return &dockerBuilder{cli: cli}, nil
+	case "buildah":
+		return &buildahBuilder{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported builder '%s'", options.Builder)
+	}
+}
+
+// dockerBuilder is the classic Builder backed by the Docker Engine API.
+type dockerBuilder struct {
+	cli client.APIClient
+}
+
+func (b *dockerBuilder) Build(ctx context.Context, req BuildRequest) (io.ReadCloser, error) {
+	resp, err := b.cli.ImageBuild(ctx, req.Context, types.ImageBuildOptions{
+		NoCache:    req.NoCache,
+		Dockerfile: req.Dockerfile,
+		BuildArgs:  req.BuildArgs,
+		Squash:     req.Squash,
+		Target:     req.Target,
+		Tags:       []string{req.Tag},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *dockerBuilder) Push(ctx context.Context, tag string, auth *types.AuthConfig) (io.ReadCloser, error) {
+	registryAuth, err := encodeRegistryAuth(auth)
+	if err != nil {
+		return nil, err
+	}
+	return b.cli.ImagePush(ctx, tag, types.ImagePushOptions{
+		All:          false,
+		RegistryAuth: registryAuth,
+	})
+}
+
+// buildahBuilder drives `buildah bud`/`buildah push` against a materialized
+// build context, the same rootless daemonless path buildBuildah gives the
+// Module API, exposed here behind Builder so BuildSpec.Build/BuildEx can use
+// it without a Docker daemon at all.
+type buildahBuilder struct{}
+
+func (b *buildahBuilder) Build(ctx context.Context, req BuildRequest) (io.ReadCloser, error) {
+	contextDir, err := ioutil.TempDir("", "kindest-buildah-context-")
+	if err != nil {
+		return nil, err
+	}
+	if err := untarToDir(req.Context, contextDir); err != nil {
+		os.RemoveAll(contextDir)
+		return nil, fmt.Errorf("failed to extract build context: %v", err)
+	}
+	args := []string{
+		"bud",
+		"--file", filepath.Join(contextDir, req.Dockerfile),
+		"--tag", req.Tag,
+	}
+	if req.NoCache {
+		args = append(args, "--no-cache")
+	}
+	if req.Squash {
+		args = append(args, "--squash")
+	}
+	if req.Target != "" {
+		args = append(args, "--target", req.Target)
+	}
+	for name, value := range req.BuildArgs {
+		if value != nil {
+			args = append(args, "--build-arg", fmt.Sprintf("%s=%s", name, *value))
+		}
+	}
+	args = append(args, contextDir)
+	cmd := exec.CommandContext(ctx, "buildah", args...)
+	return streamCommandAsJSON(cmd, func() { os.RemoveAll(contextDir) }, "buildah bud")
+}
+
+func (b *buildahBuilder) Push(ctx context.Context, tag string, auth *types.AuthConfig) (io.ReadCloser, error) {
+	authBytes, err := buildahAuthFileJSON(tag, auth)
+	if err != nil {
+		return nil, err
+	}
+	authFile, err := ioutil.TempFile("", "kindest-buildah-auth-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := authFile.Write(authBytes); err != nil {
+		os.Remove(authFile.Name())
+		return nil, err
+	}
+	if err := authFile.Close(); err != nil {
+		os.Remove(authFile.Name())
+		return nil, err
+	}
+	cmd := exec.CommandContext(ctx, "buildah", "push", "--authfile", authFile.Name(), tag)
+	return streamCommandAsJSON(cmd, func() { os.Remove(authFile.Name()) }, "buildah push")
+}
+
+// encodeRegistryAuth base64-encodes auth the same way RegistryAuthFromEnv's
+// callers already do for the Docker Engine API's X-Registry-Auth header, for
+// dockerBuilder.Push. The buildah backend writes its --authfile with
+// buildahAuthFileJSON instead.
+func encodeRegistryAuth(auth *types.AuthConfig) (string, error) {
+	authBytes, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(authBytes), nil
+}
+
+// streamCommandAsJSON starts cmd with its combined stdout/stderr adapted
+// live into the `{"stream": "..."}` JSON message shape the rest of the
+// package already knows how to render and decode (the same shape
+// streamBuildEvents expects from a Docker daemon response), so a Builder
+// backed by an external CLI reports progress as it happens instead of
+// buffering the whole run and only producing a stream once it's over --
+// matching how dockerBuilder.Build returns its response body before the
+// build completes. cmdLabel names the command in the error wrapped into a
+// final `{"error": "..."}` event if cmd exits non-zero; cleanup runs exactly
+// once, after cmd finishes (however it finishes), to remove any temp
+// directory/file the caller materialized for the command.
+func streamCommandAsJSON(cmd *exec.Cmd, cleanup func(), cmdLabel string) (io.ReadCloser, error) {
+	rawR, rawW := io.Pipe()
+	var captured bytes.Buffer
+	mw := io.MultiWriter(rawW, &captured)
+	cmd.Stdout = mw
+	cmd.Stderr = mw
+	if err := cmd.Start(); err != nil {
+		cleanup()
+		return nil, err
+	}
+	go func() {
+		runErr := cmd.Wait()
+		cleanup()
+		if runErr != nil {
+			rawW.CloseWithError(fmt.Errorf("%s: %v: %s", cmdLabel, runErr, captured.String()))
+		} else {
+			rawW.Close()
+		}
+	}()
+	return textLinesToJSONStream(rawR), nil
+}
+
+// textLinesToJSONStream adapts r -- the live stdout/stderr of an external
+// build CLI -- into the `{"stream": "..."}` / `{"error": "..."}` JSON
+// message shape the rest of the package already knows how to render and
+// decode, one line at a time as it arrives rather than only once the whole
+// run has finished, so handleBuildOutput can treat any Builder's result the
+// same regardless of which backend produced it.
+func textLinesToJSONStream(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(pw)
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			enc.Encode(struct {
+				Stream string `json:"stream,omitempty"`
+			}{Stream: line + "\n"})
+		}
+		if err := scanner.Err(); err != nil {
+			enc.Encode(struct {
+				Error string `json:"error,omitempty"`
+			}{Error: err.Error()})
+		}
+		pw.Close()
+	}()
+	return pr
+}
@@ -0,0 +1,280 @@
+package kindest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/moby/buildkit/client"
+	"github.com/moby/buildkit/session"
+	"github.com/moby/buildkit/session/secrets/secretsprovider"
+	"github.com/moby/buildkit/session/sshforward/sshprovider"
+	"go.uber.org/zap"
+)
+
+// defaultBuildkitAddr mirrors the address the `docker buildx` CLI falls
+// back to when BUILDKIT_HOST isn't set: the buildkitd socket exposed by a
+// local Docker Engine with the containerd image store enabled.
+const defaultBuildkitAddr = "unix:///run/buildkit/buildkitd.sock"
+
+func buildkitAddr() string {
+	if addr, ok := os.LookupEnv("BUILDKIT_HOST"); ok {
+		return addr
+	}
+	return defaultBuildkitAddr
+}
+
+// buildWithBuildKit drives a build through buildkit's gRPC client instead
+// of the classic Engine build API, so `kindest.yaml` can declare build-time
+// secrets and forward an SSH agent into `RUN --mount=type=secret|ssh`
+// instructions, and so the caller can choose docker/registry/OCI output
+// independently of how the image was built.
+func buildWithBuildKit(
+	ctx context.Context,
+	manifestPath string,
+	b *BuildSpec,
+	options *BuildOptions,
+	tag string,
+) error {
+	docker := b.Docker
+	contextPath := filepath.Clean(filepath.Join(filepath.Dir(manifestPath), docker.Context))
+	resolvedDockerfile, err := resolveDockerfile(manifestPath, docker.Dockerfile, docker.Context)
+	if err != nil {
+		return err
+	}
+	cli, err := client.New(ctx, buildkitAddr())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	attachable, err := buildkitSessionAttachments(docker)
+	if err != nil {
+		return err
+	}
+
+	frontendAttrs := buildkitFrontendAttrs(docker, options, resolvedDockerfile)
+
+	export, err := buildkitExporter(options, tag)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Building with buildkit",
+		zap.String("tag", tag),
+		zap.String("exporter", export.Type))
+	emitBuildEvent(options.Events, options.Sink, BuildEvent{
+		Kind:    BuildEventStep,
+		Module:  manifestPath,
+		Image:   tag,
+		Message: fmt.Sprintf("solving with buildkit (exporter=%s)", export.Type),
+	})
+	statusCh := make(chan *client.SolveStatus)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamBuildkitStatus(statusCh, options, manifestPath, tag)
+	}()
+	_, err = cli.Solve(ctx, nil, client.SolveOpt{
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: frontendAttrs,
+		LocalDirs: map[string]string{
+			"context":    contextPath,
+			"dockerfile": filepath.Dir(filepath.Join(contextPath, resolvedDockerfile)),
+		},
+		Session: attachable,
+		Exports: []client.ExportEntry{export},
+	}, statusCh)
+	<-done
+	return err
+}
+
+// buildkitFrontendAttrs builds the dockerfile.v0 frontend attrs for a
+// buildkit solve, covering the same options the docker/buildah backends
+// already honor: build args, the no-cache flag (buildkit's dockerfile
+// frontend reads "no-cache" rather than taking a client-side flag the way
+// the Engine API does), and a multi-stage target, so switching
+// --builder=buildkit on a module doesn't silently drop them.
+func buildkitFrontendAttrs(docker *DockerBuildSpec, options *BuildOptions, resolvedDockerfile string) map[string]string {
+	frontendAttrs := map[string]string{
+		"filename": resolvedDockerfile,
+	}
+	for _, arg := range docker.BuildArgs {
+		frontendAttrs["build-arg:"+arg.Name] = arg.Value
+	}
+	if options.NoCache {
+		frontendAttrs["no-cache"] = "true"
+	}
+	if docker.Target != "" {
+		frontendAttrs["target"] = docker.Target
+	}
+	return frontendAttrs
+}
+
+// streamBuildkitStatus drains a buildkit SolveStatus channel into BuildEvents
+// -- a Step per vertex as it starts and completes, and an Error per vertex
+// that fails -- so a buildkit build reports the same typed per-step progress
+// as the docker and native backends instead of the single static "solving
+// with buildkit" message cli.Solve would otherwise leave callers with.
+func streamBuildkitStatus(statusCh <-chan *client.SolveStatus, options *BuildOptions, manifestPath, tag string) {
+	for status := range statusCh {
+		for _, v := range status.Vertexes {
+			if v.Error != "" {
+				emitBuildEvent(options.Events, options.Sink, BuildEvent{
+					Kind:    BuildEventError,
+					Module:  manifestPath,
+					Image:   tag,
+					Message: fmt.Sprintf("%s: %s", v.Name, v.Error),
+				})
+				continue
+			}
+			switch {
+			case v.Completed != nil:
+				emitBuildEvent(options.Events, options.Sink, BuildEvent{
+					Kind:    BuildEventStep,
+					Module:  manifestPath,
+					Image:   tag,
+					Message: fmt.Sprintf("done: %s", v.Name),
+				})
+			case v.Started != nil:
+				emitBuildEvent(options.Events, options.Sink, BuildEvent{
+					Kind:    BuildEventStep,
+					Module:  manifestPath,
+					Image:   tag,
+					Message: v.Name,
+				})
+			}
+		}
+		for _, l := range status.Logs {
+			emitBuildEvent(options.Events, options.Sink, BuildEvent{
+				Module: manifestPath,
+				Image:  tag,
+				Stream: string(l.Data),
+			})
+		}
+	}
+}
+
+// buildkitSessionAttachments wires build.secrets and build.ssh from
+// kindest.yaml into buildkit's session/secrets and session/sshforward
+// providers, so Dockerfiles can declare
+// `RUN --mount=type=secret,id=<id>` / `RUN --mount=type=ssh,id=<id>`.
+func buildkitSessionAttachments(docker *DockerBuildSpec) ([]session.Attachable, error) {
+	var attachable []session.Attachable
+	if len(docker.Secrets) > 0 {
+		var sources []secretsprovider.Source
+		for _, secret := range docker.Secrets {
+			sources = append(sources, secretsprovider.Source{
+				ID:       secret.ID,
+				FilePath: secret.Src,
+			})
+		}
+		store, err := secretsprovider.NewStore(sources)
+		if err != nil {
+			return nil, err
+		}
+		attachable = append(attachable, secretsprovider.NewSecretProvider(store))
+	}
+	for _, ssh := range docker.SSH {
+		cfg := sshprovider.AgentConfig{
+			ID:    ssh.ID,
+			Paths: ssh.Paths,
+		}
+		provider, err := sshprovider.NewSSHAgentProvider([]sshprovider.AgentConfig{cfg})
+		if err != nil {
+			return nil, err
+		}
+		attachable = append(attachable, provider)
+	}
+	return attachable, nil
+}
+
+// buildkitExporter maps BuildOptions.Exporter (and the legacy Push flag)
+// onto a buildkit export entry: "image" (also used when Exporter is empty and
+// Push is set) pushes straight to the registry (no Output sink needed --
+// buildkit writes directly to the registry itself),
+// "oci" writes a tarball to ExporterOutput, and anything else pipes the
+// result into `docker load` to land it in the local daemon. The docker/oci
+// exporters both require an Output callback -- buildkit's client refuses to
+// solve without one for anything but the image exporter.
+func buildkitExporter(options *BuildOptions, tag string) (client.ExportEntry, error) {
+	exporter := options.Exporter
+	if exporter == "" && options.Push {
+		exporter = "image"
+	}
+	switch exporter {
+	case "image":
+		return client.ExportEntry{
+			Type: "image",
+			Attrs: map[string]string{
+				"name": tag,
+				"push": "true",
+			},
+		}, nil
+	case "oci":
+		if options.ExporterOutput == "" {
+			return client.ExportEntry{}, fmt.Errorf("exporterOutput is required for the oci exporter")
+		}
+		return client.ExportEntry{
+			Type:   "oci",
+			Output: fileExportOutput(options.ExporterOutput),
+		}, nil
+	default:
+		return client.ExportEntry{
+			Type:   "docker",
+			Attrs:  map[string]string{"name": tag},
+			Output: dockerLoadOutput(),
+		}, nil
+	}
+}
+
+// fileExportOutput opens path for writing, handing buildkit's oci exporter
+// somewhere to stream its tarball.
+func fileExportOutput(path string) func(map[string]string) (io.WriteCloser, error) {
+	return func(map[string]string) (io.WriteCloser, error) {
+		return os.Create(path)
+	}
+}
+
+// dockerLoadOutput pipes buildkit's docker-exporter tarball into `docker
+// load`, the same way `docker buildx build` lands a build into the local
+// daemon without a registry round-trip. The returned WriteCloser's Close
+// waits for `docker load` to finish and surfaces its exit error, so a
+// malformed tarball still fails the build instead of silently dropping it.
+func dockerLoadOutput() func(map[string]string) (io.WriteCloser, error) {
+	return func(map[string]string) (io.WriteCloser, error) {
+		cmd := exec.Command("docker", "load")
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &dockerLoadPipe{stdin: stdin, cmd: cmd}, nil
+	}
+}
+
+// dockerLoadPipe adapts a `docker load` subprocess's stdin into the
+// io.WriteCloser buildkit's Output callback expects, waiting for the
+// subprocess to exit on Close so its error surfaces through cli.Solve.
+type dockerLoadPipe struct {
+	stdin io.WriteCloser
+	cmd   *exec.Cmd
+}
+
+func (p *dockerLoadPipe) Write(b []byte) (int, error) {
+	return p.stdin.Write(b)
+}
+
+func (p *dockerLoadPipe) Close() error {
+	if err := p.stdin.Close(); err != nil {
+		return err
+	}
+	return p.cmd.Wait()
+}
@@ -0,0 +1,27 @@
+package kindest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildkitFrontendAttrs(t *testing.T) {
+	docker := &DockerBuildSpec{
+		BuildArgs: []*DockerBuildArg{{Name: "SRC", Value: "cmd"}},
+		Target:    "builder",
+	}
+	attrs := buildkitFrontendAttrs(docker, &BuildOptions{NoCache: true}, "Dockerfile")
+	require.Equal(t, "Dockerfile", attrs["filename"])
+	require.Equal(t, "cmd", attrs["build-arg:SRC"])
+	require.Equal(t, "true", attrs["no-cache"])
+	require.Equal(t, "builder", attrs["target"])
+}
+
+func TestBuildkitFrontendAttrsOmitsUnsetFields(t *testing.T) {
+	attrs := buildkitFrontendAttrs(&DockerBuildSpec{}, &BuildOptions{}, "Dockerfile")
+	_, hasNoCache := attrs["no-cache"]
+	_, hasTarget := attrs["target"]
+	require.False(t, hasNoCache, "no-cache must be omitted when NoCache is false, not sent as \"false\"")
+	require.False(t, hasTarget, "target must be omitted when no multi-stage target is set")
+}
@@ -0,0 +1,674 @@
+package kindest
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/docker/docker/pkg/fileutils"
+	imgspecv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+	"github.com/opencontainers/runtime-tools/generate"
+	"go.uber.org/zap"
+)
+
+// buildNative drives a build without a Docker daemon at all: it pulls the
+// base image straight into a local OCI layout with containers/image,
+// interprets the rest of the Dockerfile itself against an unpacked rootfs
+// (each RUN executes inside a throwaway runc container, chrooted to that
+// rootfs), and writes the result back out as a new image in the same
+// layout. This is what lets `builder: native` work on hosts with no dockerd
+// reachable at all -- rootless CI runners, restricted Kubernetes Jobs, and
+// the like -- at the cost of not supporting BuildKit-only Dockerfile syntax.
+func buildNative(
+	ctx context.Context,
+	manifestPath string,
+	b *BuildSpec,
+	options *BuildOptions,
+	tag string,
+) error {
+	docker := b.Docker
+	var contextPath string
+	if isRemoteContext(docker.Context) {
+		resolved, err := resolveRemoteContext(ctx, docker.Context, options)
+		if err != nil {
+			return fmt.Errorf("failed to fetch remote build context: %v", err)
+		}
+		contextPath = resolved
+	} else {
+		contextPath = filepath.Clean(filepath.Join(filepath.Dir(manifestPath), docker.Context))
+	}
+	resolvedDockerfile, err := resolveDockerfile(manifestPath, docker.Dockerfile, docker.Context)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadFile(filepath.Join(contextPath, resolvedDockerfile))
+	if err != nil {
+		return err
+	}
+	result, err := parser.Parse(strings.NewReader(string(body)))
+	if err != nil {
+		return fmt.Errorf("failed to parse Dockerfile: %v", err)
+	}
+
+	layoutDir, err := nativeLayoutDir()
+	if err != nil {
+		return err
+	}
+
+	// Each FROM gets its own rootfs, keyed by both its stage index and (if
+	// given) its "AS <name>" alias, so a later `COPY --from=<stage>` copies
+	// out of that stage's own finished filesystem instead of the stage
+	// currently being built unpacking right on top of it.
+	var rootfs string
+	var stageDirs []string
+	stageByName := map[string]string{}
+	defer func() {
+		for _, dir := range stageDirs {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	args := map[string]string{}
+	for _, arg := range docker.BuildArgs {
+		args[arg.Name] = arg.Value
+	}
+	env := map[string]string{}
+	workdir := "/"
+	var cmd, entrypoint []string
+
+	log.Info("Building natively (no Docker daemon)", zap.String("tag", tag))
+	totalSteps := len(result.AST.Children)
+	for step, child := range result.AST.Children {
+		emitBuildEvent(options.Events, options.Sink, BuildEvent{
+			Kind:       BuildEventStep,
+			Module:     manifestPath,
+			Image:      tag,
+			Step:       step + 1,
+			TotalSteps: totalSteps,
+			Message:    child.Original,
+		})
+		switch strings.ToLower(child.Value) {
+		case command.From:
+			from := expandBuildArgs(child.Next.Value, args)
+			dir, err := ioutil.TempDir("", "kindest-native-rootfs-")
+			if err != nil {
+				return err
+			}
+			stageDirs = append(stageDirs, dir)
+			if err := pullAndUnpack(ctx, layoutDir, from, dir); err != nil {
+				return fmt.Errorf("FROM %s: %v", from, err)
+			}
+			rootfs = dir
+			stageByName[strconv.Itoa(len(stageDirs)-1)] = dir
+			if name := fromStageName(child); name != "" {
+				stageByName[name] = dir
+			}
+		case command.Arg:
+			name, value := parseArgInstruction(child.Next.Value)
+			if _, ok := args[name]; !ok && value != "" {
+				args[name] = value
+			}
+		case command.Env:
+			fields := copyNodeValues(child)
+			for i := 0; i+1 < len(fields); i += 2 {
+				env[fields[i]] = expandBuildArgs(fields[i+1], args)
+			}
+		case command.Workdir:
+			workdir = expandBuildArgs(child.Next.Value, args)
+		case command.Copy, command.Add:
+			sources, dest := copySourcesAndDest(child)
+			for i, src := range sources {
+				sources[i] = expandBuildArgs(src, args)
+			}
+			srcRoot := contextPath
+			var excludes []string
+			if fromStage := copyFromStage(child); fromStage != "" {
+				dir, ok := stageByName[fromStage]
+				if !ok {
+					return fmt.Errorf("%s --from=%s: unknown build stage", child.Value, fromStage)
+				}
+				srcRoot = dir
+			} else {
+				excludes, err = dockerIgnoreExcludes(contextPath, resolvedDockerfile)
+				if err != nil {
+					return err
+				}
+			}
+			if err := copyIntoRootfs(srcRoot, rootfs, sources, expandBuildArgs(dest, args), excludes); err != nil {
+				return fmt.Errorf("%s: %v", child.Value, err)
+			}
+		case command.Run:
+			shellCmd := expandBuildArgs(strings.Join(copyNodeValues(child), " "), args)
+			if err := runInRootfs(rootfs, workdir, env, shellCmd); err != nil {
+				return fmt.Errorf("RUN %s: %v", shellCmd, err)
+			}
+		case command.Cmd:
+			cmd = copyNodeValues(child)
+		case command.Entrypoint:
+			entrypoint = copyNodeValues(child)
+		}
+	}
+
+	if err := packOCIImage(layoutDir, tag, rootfs, env, workdir, entrypoint, cmd); err != nil {
+		return err
+	}
+	if options.Push {
+		return pushOCIImage(ctx, layoutDir, tag)
+	}
+	return nil
+}
+
+// nativeLayoutDir is where pulled base images and images built by the
+// native backend are kept, as a single shared OCI image layout.
+func nativeLayoutDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".kindest", "native", "layout")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func copyNodeValues(node *parser.Node) []string {
+	var values []string
+	for n := node.Next; n != nil; n = n.Next {
+		values = append(values, n.Value)
+	}
+	return values
+}
+
+// pullAndUnpack copies ref into the shared OCI layout (if it isn't already
+// there) and extracts its layers, in order, on top of rootfs.
+func pullAndUnpack(ctx context.Context, layoutDir, ref, rootfs string) error {
+	ociRef := nativeOCIRef(ref)
+	srcRef, err := alltransports.ParseImageName("docker://" + ref)
+	if err != nil {
+		return err
+	}
+	destRef, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s:%s", layoutDir, ociRef))
+	if err != nil {
+		return err
+	}
+	policyCtx, err := signature.NewPolicyContext(&signature.Policy{
+		Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return err
+	}
+	defer policyCtx.Destroy()
+	if _, err := copy.Image(ctx, policyCtx, destRef, srcRef, nil); err != nil {
+		return fmt.Errorf("failed to pull %s: %v", ref, err)
+	}
+	return unpackOCIImage(layoutDir, ociRef, rootfs)
+}
+
+func nativeOCIRef(ref string) string {
+	h := sha256.Sum256([]byte(ref))
+	return "base-" + hex.EncodeToString(h[:])[:16]
+}
+
+// unpackOCIImage reads the manifest tagged ociRef out of the shared layout
+// and extracts every layer, in order, on top of dest -- the same tar-layer
+// application a Docker daemon does when it assembles a container rootfs.
+func unpackOCIImage(layoutDir, ociRef, dest string) error {
+	index, err := readOCIIndex(layoutDir)
+	if err != nil {
+		return err
+	}
+	manifestDigest, err := findOCIRef(index, ociRef)
+	if err != nil {
+		return err
+	}
+	manifest, err := readOCIManifest(layoutDir, manifestDigest)
+	if err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		if err := extractOCILayer(layoutDir, layer.Digest.String(), dest); err != nil {
+			return fmt.Errorf("failed to extract layer %s: %v", layer.Digest, err)
+		}
+	}
+	return nil
+}
+
+func readOCIIndex(layoutDir string) (*imgspecv1.Index, error) {
+	body, err := ioutil.ReadFile(filepath.Join(layoutDir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	index := &imgspecv1.Index{}
+	if err := json.Unmarshal(body, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func findOCIRef(index *imgspecv1.Index, ociRef string) (string, error) {
+	for _, desc := range index.Manifests {
+		if desc.Annotations["org.opencontainers.image.ref.name"] == ociRef {
+			return desc.Digest.String(), nil
+		}
+	}
+	return "", fmt.Errorf("ref %s not found in OCI layout", ociRef)
+}
+
+func readOCIManifest(layoutDir, digest string) (*imgspecv1.Manifest, error) {
+	body, err := ioutil.ReadFile(ociBlobPath(layoutDir, digest))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &imgspecv1.Manifest{}
+	if err := json.Unmarshal(body, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func ociBlobPath(layoutDir, digest string) string {
+	parts := strings.SplitN(digest, ":", 2)
+	return filepath.Join(layoutDir, "blobs", parts[0], parts[1])
+}
+
+// ociWhiteoutPrefix and ociOpaqueWhiteout are the OCI image-spec's whiteout
+// conventions (https://github.com/opencontainers/image-spec/blob/main/layer.md#whiteouts)
+// for representing a deletion (or directory replacement) from a lower layer
+// without having to rewrite that layer: a tar entry named ".wh.<name>" means
+// "<name> was deleted here", and ".wh..wh..opq" inside a directory means
+// "everything already in this directory from a lower layer is gone".
+const (
+	ociWhiteoutPrefix = ".wh."
+	ociOpaqueWhiteout = ".wh..wh..opq"
+)
+
+func extractOCILayer(layoutDir, digest, dest string) error {
+	f, err := os.Open(ociBlobPath(layoutDir, digest))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		path, err := safeJoinTarPath(dest, header.Name)
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(header.Name)
+		if base == ociOpaqueWhiteout {
+			entries, err := ioutil.ReadDir(filepath.Dir(path))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			for _, entry := range entries {
+				if err := os.RemoveAll(filepath.Join(filepath.Dir(path), entry.Name())); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(base, ociWhiteoutPrefix) {
+			deleted := filepath.Join(filepath.Dir(path), strings.TrimPrefix(base, ociWhiteoutPrefix))
+			if err := os.RemoveAll(deleted); err != nil {
+				return err
+			}
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.Remove(path)
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// copyIntoRootfs applies one COPY/ADD instruction directly against rootfs,
+// the same semantics BuildContext.Archive gives the Docker daemon: a single
+// source copies to dest verbatim, multiple sources are copied into dest as
+// a directory, and a directory source has its contents (not the directory
+// itself) copied into dest. srcRoot is the host build context for a plain COPY/ADD, or a
+// prior stage's own finished rootfs for `COPY --from=<stage>`, in which case
+// excludes is nil since .dockerignore only governs what enters the build
+// context, not stage-to-stage copies.
+func copyIntoRootfs(srcRoot, rootfs string, sources []string, dest string, excludes []string) error {
+	matcher, err := fileutils.NewPatternMatcher(excludes)
+	if err != nil {
+		return err
+	}
+	destPath := filepath.Join(rootfs, dest)
+	multiple := len(sources) > 1 || strings.HasSuffix(dest, "/")
+	if multiple {
+		if err := os.MkdirAll(destPath, 0755); err != nil {
+			return err
+		}
+	}
+	for _, src := range sources {
+		srcPath := filepath.Join(srcRoot, src)
+		info, err := os.Stat(srcPath)
+		if err != nil {
+			return err
+		}
+		target := destPath
+		if multiple && !info.IsDir() {
+			target = filepath.Join(destPath, filepath.Base(srcPath))
+		}
+		if err := copyTree(srcRoot, srcPath, target, matcher); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree mirrors the Docker/kaniko COPY semantics: a file or directory
+// excluded by the build context's .dockerignore (relative to contextPath,
+// the same root dockerIgnoreExcludes resolved matcher's patterns against)
+// is silently skipped instead of landing in rootfs, the same guarantee
+// archive.TarWithOptions already gives the docker/buildah/buildkit backends.
+func copyTree(contextPath, src, dest string, matcher *fileutils.PatternMatcher) error {
+	rel, err := filepath.Rel(contextPath, src)
+	if err == nil {
+		if matched, err := matcher.Matches(filepath.ToSlash(rel)); err != nil {
+			return err
+		} else if matched {
+			return nil
+		}
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		in, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	}
+	if err := os.MkdirAll(dest, info.Mode()); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := copyTree(contextPath, filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name()), matcher); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runInRootfs executes shellCmd inside rootfs via a throwaway runc
+// container, rather than invoking the Docker daemon's exec API.
+func runInRootfs(rootfs, workdir string, env map[string]string, shellCmd string) error {
+	bundle, err := ioutil.TempDir("", "kindest-native-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(bundle)
+	g, err := generate.New("linux")
+	if err != nil {
+		return err
+	}
+	g.SetRootPath(rootfs)
+	g.SetProcessArgs([]string{"/bin/sh", "-c", shellCmd})
+	g.SetProcessCwd(workdir)
+	for k, v := range env {
+		g.AddProcessEnv(k, v)
+	}
+	if err := g.SaveToFile(filepath.Join(bundle, "config.json"), generate.ExportOptions{}); err != nil {
+		return err
+	}
+	containerID := "kindest-native-" + filepath.Base(bundle)
+	cmd := exec.Command("runc", "run", "--bundle", bundle, containerID)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("runc run: %v", err)
+	}
+	return nil
+}
+
+// packOCIImage tars up rootfs as a single layer and writes it, alongside a
+// config and manifest, into the shared OCI layout under tag.
+func packOCIImage(
+	layoutDir, tag, rootfs string,
+	env map[string]string,
+	workdir string,
+	entrypoint, cmd []string,
+) error {
+	blobsDir := filepath.Join(layoutDir, "blobs", "sha256")
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return err
+	}
+	layerDigest, layerSize, err := tarDirToBlob(rootfs, blobsDir)
+	if err != nil {
+		return err
+	}
+	envList := make([]string, 0, len(env))
+	for k, v := range env {
+		envList = append(envList, fmt.Sprintf("%s=%s", k, v))
+	}
+	config := imgspecv1.Image{
+		OS:           "linux",
+		Architecture: "amd64",
+		Config: imgspecv1.ImageConfig{
+			Env:        envList,
+			WorkingDir: workdir,
+			Entrypoint: entrypoint,
+			Cmd:        cmd,
+		},
+		RootFS: imgspecv1.RootFS{
+			Type:    "layers",
+			DiffIDs: []imgspecv1.Digest{imgspecv1.Digest("sha256:" + layerDigest)},
+		},
+	}
+	configDigest, configSize, err := writeJSONBlob(blobsDir, config)
+	if err != nil {
+		return err
+	}
+	manifest := imgspecv1.Manifest{
+		Versioned: manifestVersion(),
+		Config: imgspecv1.Descriptor{
+			MediaType: imgspecv1.MediaTypeImageConfig,
+			Digest:    imgspecv1.Digest("sha256:" + configDigest),
+			Size:      configSize,
+		},
+		Layers: []imgspecv1.Descriptor{{
+			MediaType: imgspecv1.MediaTypeImageLayer,
+			Digest:    imgspecv1.Digest("sha256:" + layerDigest),
+			Size:      layerSize,
+		}},
+	}
+	manifestDigest, manifestSize, err := writeJSONBlob(blobsDir, manifest)
+	if err != nil {
+		return err
+	}
+	return addOCIIndexEntry(layoutDir, tag, manifestDigest, manifestSize)
+}
+
+func tarDirToBlob(dir, blobsDir string) (digest string, size int64, err error) {
+	tmp, err := ioutil.TempFile(blobsDir, "layer-")
+	if err != nil {
+		return "", 0, err
+	}
+	h := sha256.New()
+	mw := io.MultiWriter(tmp, h)
+	tw := tar.NewWriter(mw)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(tw, f)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	if err := tw.Close(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+	size = info.Size()
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+	digest = hex.EncodeToString(h.Sum(nil))
+	return digest, size, os.Rename(tmp.Name(), filepath.Join(blobsDir, digest))
+}
+
+func writeJSONBlob(blobsDir string, v interface{}) (digest string, size int64, err error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return "", 0, err
+	}
+	h := sha256.Sum256(body)
+	digest = hex.EncodeToString(h[:])
+	if err := ioutil.WriteFile(filepath.Join(blobsDir, digest), body, 0644); err != nil {
+		return "", 0, err
+	}
+	return digest, int64(len(body)), nil
+}
+
+func addOCIIndexEntry(layoutDir, ref, manifestDigest string, manifestSize int64) error {
+	indexPath := filepath.Join(layoutDir, "index.json")
+	index := &imgspecv1.Index{Versioned: manifestVersion()}
+	if body, err := ioutil.ReadFile(indexPath); err == nil {
+		if err := json.Unmarshal(body, index); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	entry := imgspecv1.Descriptor{
+		MediaType: imgspecv1.MediaTypeImageManifest,
+		Digest:    imgspecv1.Digest("sha256:" + manifestDigest),
+		Size:      manifestSize,
+		Annotations: map[string]string{
+			"org.opencontainers.image.ref.name": ref,
+		},
+	}
+	var manifests []imgspecv1.Descriptor
+	for _, desc := range index.Manifests {
+		if desc.Annotations["org.opencontainers.image.ref.name"] != ref {
+			manifests = append(manifests, desc)
+		}
+	}
+	index.Manifests = append(manifests, entry)
+	body, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(indexPath, body, 0644)
+}
+
+func manifestVersion() imgspecv1.Versioned {
+	return imgspecv1.Versioned{SchemaVersion: 2}
+}
+
+// pushOCIImage copies an image out of the shared local layout to a remote
+// registry, reusing the same containers/image copy path buildNative used to
+// pull the base image.
+func pushOCIImage(ctx context.Context, layoutDir, tag string) error {
+	srcRef, err := alltransports.ParseImageName(fmt.Sprintf("oci:%s:%s", layoutDir, tag))
+	if err != nil {
+		return err
+	}
+	destRef, err := alltransports.ParseImageName("docker://" + tag)
+	if err != nil {
+		return err
+	}
+	policyCtx, err := signature.NewPolicyContext(&signature.Policy{
+		Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+	})
+	if err != nil {
+		return err
+	}
+	defer policyCtx.Destroy()
+	if _, err := copy.Image(ctx, policyCtx, destRef, srcRef, nil); err != nil {
+		return fmt.Errorf("failed to push %s: %v", tag, err)
+	}
+	return nil
+}
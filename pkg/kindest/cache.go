@@ -0,0 +1,124 @@
+package kindest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/crane"
+
+	"github.com/midcontinentcontrols/kindest/pkg/logger"
+)
+
+// BuildCache maps a content-addressable digest to a previously pushed image
+// reference, letting Module.doBuild skip a rebuild whose result is already
+// sitting in the registry. Unlike CachedDigest/cacheDigest (which only
+// remember the last digest built on this workstation), an implementation of
+// BuildCache is expected to be shared across developers and CI runners.
+type BuildCache interface {
+	// Lookup returns the image reference previously stored for digest, if
+	// any. ok is false (with a nil error) on a plain cache miss.
+	Lookup(repository string, digest string) (ref string, ok bool, err error)
+	// Store records that dest was built from digest.
+	Store(repository string, digest string, dest string) error
+}
+
+// registryBuildCache stores {digest -> pushed image reference} mappings as
+// tags in the destination registry itself (sha256-<digest>.buildcache),
+// rather than on local disk, so the cache is naturally shared by anyone
+// pulling from the same registry.
+type registryBuildCache struct {
+	log logger.Logger
+}
+
+// NewRegistryBuildCache returns a BuildCache backed by tags in the
+// destination registry.
+func NewRegistryBuildCache(log logger.Logger) BuildCache {
+	return &registryBuildCache{log: log}
+}
+
+func cacheTagFor(repository, digest string) string {
+	return fmt.Sprintf("%s:sha256-%s.buildcache", repository, digest)
+}
+
+func (c *registryBuildCache) Lookup(repository, digest string) (string, bool, error) {
+	tag := cacheTagFor(repository, digest)
+	if _, err := crane.Manifest(tag); err != nil {
+		// Treat any failure to resolve the cache tag (not found, registry
+		// unreachable, auth failure) as a miss -- the caller falls back to
+		// building from scratch either way.
+		return "", false, nil
+	}
+	return tag, true, nil
+}
+
+func (c *registryBuildCache) Store(repository, digest, dest string) error {
+	tag := cacheTagFor(repository, digest)
+	if err := crane.Tag(dest, tagOnly(tag)); err != nil {
+		return fmt.Errorf("failed to tag build cache entry: %v", err)
+	}
+	return nil
+}
+
+// shouldLookupRemoteBuildCache reports whether Module.doBuild should consult
+// options.BuildCache for a hit before building: NoCache forces a rebuild
+// regardless of what's cached, and NoPush means the caller doesn't want dest
+// to end up pointing at a registry-side image at all, so a cache hit (which
+// retags dest via a registry-side copy, not a local build) would mutate the
+// registry despite NoPush just as surely as an explicit push would.
+func shouldLookupRemoteBuildCache(options *BuildOptions) bool {
+	return options.BuildCache != nil && !options.NoCache && !options.NoPush
+}
+
+// retagFromCache points dest at the already-built image stored under the
+// cache tag ref, via a registry-side manifest copy rather than a rebuild.
+func retagFromCache(ref, dest string) error {
+	if err := crane.Copy(ref, dest); err != nil {
+		return fmt.Errorf("failed to retag cached image %s to %s: %v", ref, dest, err)
+	}
+	return nil
+}
+
+func tagOnly(ref string) string {
+	for i := len(ref) - 1; i >= 0; i-- {
+		if ref[i] == ':' {
+			return ref[i+1:]
+		}
+		if ref[i] == '/' {
+			break
+		}
+	}
+	return ref
+}
+
+// repositoryOnly strips the trailing ":<tag>" off ref (if any), the
+// complement of tagOnly, so callers that only have a full "repo:tag"
+// reference can pass BuildCache the bare repository it expects.
+func repositoryOnly(ref string) string {
+	for i := len(ref) - 1; i >= 0; i-- {
+		if ref[i] == ':' {
+			return ref[:i]
+		}
+		if ref[i] == '/' {
+			break
+		}
+	}
+	return ref
+}
+
+// combinedDigest folds this module's own content digest together with the
+// cached digests of its dependencies, so that rebuilding a base module
+// correctly invalidates the cache entry for everything depending on it.
+func (m *Module) combinedDigest(digest string) (string, error) {
+	h := sha256.New()
+	h.Write([]byte(digest))
+	for _, dep := range m.Dependencies {
+		depDigest, err := dep.CachedDigest()
+		if err != nil && err != ErrModuleNotCached {
+			return "", err
+		}
+		h.Write([]byte(dep.Dir))
+		h.Write([]byte(depDigest))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,58 @@
+package kindest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBuildCache is a minimal BuildCache whose Lookup/Store are never
+// expected to be called in these tests -- shouldLookupRemoteBuildCache is
+// pure logic over *BuildOptions and shouldn't need to touch either method.
+type fakeBuildCache struct{}
+
+func (fakeBuildCache) Lookup(repository, digest string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (fakeBuildCache) Store(repository, digest, dest string) error {
+	return nil
+}
+
+func TestShouldLookupRemoteBuildCache(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		options *BuildOptions
+		want    bool
+	}{
+		{
+			name:    "no cache configured",
+			options: &BuildOptions{},
+			want:    false,
+		},
+		{
+			name:    "cache configured",
+			options: &BuildOptions{BuildCache: fakeBuildCache{}},
+			want:    true,
+		},
+		{
+			name:    "NoCache forces a rebuild even with a cache configured",
+			options: &BuildOptions{BuildCache: fakeBuildCache{}, NoCache: true},
+			want:    false,
+		},
+		{
+			name:    "NoPush must skip the lookup even though a cache hit would otherwise apply",
+			options: &BuildOptions{BuildCache: fakeBuildCache{}, NoPush: true},
+			want:    false,
+		},
+		{
+			name:    "NoCache and NoPush both set",
+			options: &BuildOptions{BuildCache: fakeBuildCache{}, NoCache: true, NoPush: true},
+			want:    false,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.want, shouldLookupRemoteBuildCache(test.options))
+		})
+	}
+}
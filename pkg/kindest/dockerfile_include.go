@@ -0,0 +1,149 @@
+package kindest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/monochromegane/go-gitignore"
+	"github.com/openshift/imagebuilder/dockerfile/command"
+	"github.com/openshift/imagebuilder/dockerfile/parser"
+)
+
+// createDockerInclude walks the real Dockerfile AST (rather than scanning
+// lines by hand) to build the set of host paths pulled in by COPY/ADD, so
+// that continuation lines, ARG-substituted sources, multiple sources per
+// instruction, and `COPY --from=<stage>` (which never touches the host) are
+// all handled the way the Docker daemon itself interprets them. buildArgs
+// seeds the ARG values from kindest.yaml's docker.buildArgs, so an ARG with
+// no in-Dockerfile default (the common `ARG SRC` + `COPY ${SRC}/main.go .`
+// pattern) still resolves instead of leaving the literal `${SRC}` in the
+// path the Dockerfile itself declares as its own default when given one.
+func createDockerInclude(contextPath string, dockerfilePath string, buildArgs []*DockerBuildArg) (gitignore.IgnoreMatcher, error) {
+	f, err := os.Open(dockerfilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result, err := parser.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Dockerfile: %v", err)
+	}
+	args := map[string]string{}
+	for _, arg := range buildArgs {
+		args[arg.Name] = arg.Value
+	}
+	stages := map[string]bool{}
+	var addedPaths []string
+	addPath := func(rel string) error {
+		abs := filepath.Clean(filepath.Join(contextPath, rel))
+		info, err := os.Stat(abs)
+		if err != nil {
+			return fmt.Errorf("failed to stat %v", abs)
+		}
+		if info.IsDir() && !strings.HasSuffix(rel, "/") {
+			rel += "/"
+		}
+		parts := strings.Split(rel, "/")
+		for i := range parts {
+			full := filepath.Join(parts[:i+1]...)
+			found := false
+			for _, item := range addedPaths {
+				if item == full {
+					found = true
+					break
+				}
+			}
+			if !found {
+				addedPaths = append(addedPaths, full)
+			}
+		}
+		return nil
+	}
+	for _, child := range result.AST.Children {
+		switch strings.ToLower(child.Value) {
+		case command.Arg:
+			name, value := parseArgInstruction(child.Next.Value)
+			if _, ok := args[name]; !ok && value != "" {
+				// An explicit docker.buildArgs entry (seeded above) always
+				// wins over the Dockerfile's own ARG default, the same
+				// precedence `docker build --build-arg` gives callers.
+				args[name] = value
+			}
+		case command.From:
+			if name := fromStageName(child); name != "" {
+				stages[name] = true
+			}
+		case command.Copy, command.Add:
+			sources, dest := copySourcesAndDest(child)
+			if fromStage := copyFromStage(child); fromStage != "" || stages[fromStage] {
+				// Files come from a prior build stage, not the host.
+				continue
+			}
+			_ = dest
+			for _, src := range sources {
+				src = expandBuildArgs(src, args)
+				if err := addPath(src); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return gitignore.NewGitIgnoreFromReader(
+		"",
+		bytes.NewBuffer([]byte(strings.Join(addedPaths, "\n"))),
+	), nil
+}
+
+// copySourcesAndDest returns every source argument of a COPY/ADD node except
+// the final (destination) argument, skipping flags like --chown/--chmod.
+func copySourcesAndDest(node *parser.Node) ([]string, string) {
+	var values []string
+	for n := node.Next; n != nil; n = n.Next {
+		values = append(values, n.Value)
+	}
+	if len(values) < 2 {
+		return values, ""
+	}
+	return values[:len(values)-1], values[len(values)-1]
+}
+
+// fromStageName returns the name a FROM instruction assigns via "AS <name>",
+// or "" for a stage with no alias.
+func fromStageName(child *parser.Node) string {
+	fields := strings.Fields(child.Original)
+	if len(fields) >= 4 && strings.EqualFold(fields[2], "as") {
+		return fields[3]
+	}
+	return ""
+}
+
+// copyFromStage returns the stage named by a COPY/ADD instruction's
+// --from=<stage> flag, or "" if the instruction copies from the host build
+// context instead of a prior stage.
+func copyFromStage(child *parser.Node) string {
+	for _, flag := range child.Flags {
+		if strings.HasPrefix(flag, "--from=") {
+			return strings.TrimPrefix(flag, "--from=")
+		}
+	}
+	return ""
+}
+
+func parseArgInstruction(raw string) (string, string) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) == 2 {
+		return parts[0], strings.Trim(parts[1], `"'`)
+	}
+	return parts[0], ""
+}
+
+func expandBuildArgs(src string, args map[string]string) string {
+	for name, value := range args {
+		src = strings.ReplaceAll(src, "${"+name+"}", value)
+		src = strings.ReplaceAll(src, "$"+name, value)
+	}
+	return src
+}
@@ -0,0 +1,93 @@
+package kindest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateDockerIncludeARGExpansion(t *testing.T) {
+	contextPath := filepath.Join("tmp", "test-"+uuid.New().String()[:8])
+	require.NoError(t, os.MkdirAll(filepath.Join(contextPath, "cmd"), 0755))
+	defer os.RemoveAll(contextPath)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contextPath, "cmd", "main.go"), []byte("package main"), 0644))
+
+	dockerfilePath := filepath.Join(contextPath, "Dockerfile")
+	dockerfile := `FROM golang:1.16 AS builder
+ARG SRC=cmd
+COPY ${SRC}/main.go .
+FROM alpine:3.11.6
+COPY --from=builder /main /main
+`
+	require.NoError(t, ioutil.WriteFile(dockerfilePath, []byte(dockerfile), 0644))
+
+	include, err := createDockerInclude(contextPath, dockerfilePath, nil)
+	require.NoError(t, err)
+	require.True(t, include.Match("cmd/main.go", false), "a path COPY'd via ARG expansion should be included, not ignored")
+	require.False(t, include.Match("unrelated.go", false), "a path never referenced by any COPY/ADD should stay ignored")
+}
+
+func TestCreateDockerIncludeBuildArgsOverrideDockerfileDefault(t *testing.T) {
+	contextPath := filepath.Join("tmp", "test-"+uuid.New().String()[:8])
+	require.NoError(t, os.MkdirAll(filepath.Join(contextPath, "cmd"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(contextPath, "other"), 0755))
+	defer os.RemoveAll(contextPath)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contextPath, "cmd", "main.go"), []byte("package main"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(contextPath, "other", "main.go"), []byte("package main"), 0644))
+
+	dockerfilePath := filepath.Join(contextPath, "Dockerfile")
+	dockerfile := `FROM golang:1.16
+ARG SRC=cmd
+COPY ${SRC}/main.go .
+`
+	require.NoError(t, ioutil.WriteFile(dockerfilePath, []byte(dockerfile), 0644))
+
+	include, err := createDockerInclude(contextPath, dockerfilePath, []*DockerBuildArg{
+		{Name: "SRC", Value: "other"},
+	})
+	require.NoError(t, err)
+	require.True(t, include.Match("other/main.go", false), "docker.buildArgs should win over the Dockerfile's own ARG default")
+	require.False(t, include.Match("cmd/main.go", false), "the Dockerfile default should be ignored once docker.buildArgs sets SRC")
+}
+
+func TestCreateDockerIncludeSkipsCopyFromStage(t *testing.T) {
+	contextPath := filepath.Join("tmp", "test-"+uuid.New().String()[:8])
+	require.NoError(t, os.MkdirAll(contextPath, 0755))
+	defer os.RemoveAll(contextPath)
+
+	dockerfilePath := filepath.Join(contextPath, "Dockerfile")
+	dockerfile := `FROM golang:1.16 AS builder
+FROM alpine:3.11.6
+COPY --from=builder /main /main
+`
+	require.NoError(t, ioutil.WriteFile(dockerfilePath, []byte(dockerfile), 0644))
+
+	include, err := createDockerInclude(contextPath, dockerfilePath, nil)
+	require.NoError(t, err)
+	require.False(t, include.Match("main", false), "COPY --from=<stage> pulls from a prior stage, not the host, and should add nothing to the include set")
+}
+
+func TestExpandBuildArgs(t *testing.T) {
+	args := map[string]string{"SRC": "cmd", "NAME": "main"}
+	require.Equal(t, "cmd/main.go", expandBuildArgs("${SRC}/main.go", args))
+	require.Equal(t, "cmd/main.go", expandBuildArgs("$SRC/main.go", args))
+	require.Equal(t, "cmd/main-main.go", expandBuildArgs("${SRC}/main-$NAME.go", args))
+}
+
+func TestParseArgInstruction(t *testing.T) {
+	name, value := parseArgInstruction("SRC=cmd")
+	require.Equal(t, "SRC", name)
+	require.Equal(t, "cmd", value)
+
+	name, value = parseArgInstruction(`SRC="cmd"`)
+	require.Equal(t, "SRC", name)
+	require.Equal(t, "cmd", value)
+
+	name, value = parseArgInstruction("SRC")
+	require.Equal(t, "SRC", name)
+	require.Equal(t, "", value)
+}
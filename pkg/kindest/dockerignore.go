@@ -0,0 +1,36 @@
+package kindest
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/builder/dockerignore"
+)
+
+// dockerIgnoreExcludes parses contextPath/.dockerignore into the exclude
+// pattern list archive.TarWithOptions expects -- "**" globs, "!" negation,
+// and "#" comments, the same semantics `docker build` itself applies via
+// github.com/docker/docker/builder/dockerignore -- returning nil if the
+// context has no .dockerignore. relDockerfile (the Dockerfile path relative
+// to contextPath) is always force-included, even if a pattern would
+// otherwise exclude it, the same guarantee the Docker CLI gives callers.
+func dockerIgnoreExcludes(contextPath, relDockerfile string) ([]string, error) {
+	f, err := os.Open(filepath.Join(contextPath, ".dockerignore"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	excludes, err := dockerignore.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if relDockerfile == "" {
+		// resolveDockerfile yields "" for the default Dockerfile at the
+		// context root; a bare "!" is an illegal exclusion pattern.
+		relDockerfile = "Dockerfile"
+	}
+	return append(excludes, "!"+filepath.ToSlash(relDockerfile)), nil
+}
@@ -0,0 +1,378 @@
+package kindest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BuildEventKind classifies a lifecycle event BuildEx itself emits, as
+// opposed to a raw progress line decoded from a backend's own output (see
+// the Stream/Aux/ErrorMessage fields below).
+type BuildEventKind string
+
+const (
+	BuildEventStart    BuildEventKind = "Start"
+	BuildEventStep     BuildEventKind = "Step"
+	BuildEventCacheHit BuildEventKind = "CacheHit"
+	BuildEventPush     BuildEventKind = "Push"
+	BuildEventDone     BuildEventKind = "Done"
+	BuildEventError    BuildEventKind = "Error"
+)
+
+// BuildEvent reports either a typed lifecycle event emitted by BuildEx
+// itself (Kind set, regardless of which backend -- docker, buildkit, or
+// native -- is driving the build) or a single decoded line of a backend's
+// own raw JSON message stream (Stream/Aux/ErrorMessage/ProgressDetail,
+// Kind empty), so callers (a UI, an HTTP server, a test) can observe build
+// progress without re-parsing jsonmessage or scanning stream text
+// themselves.
+type BuildEvent struct {
+	Kind       BuildEventKind `json:"kind,omitempty"`
+	Module     string         `json:"module,omitempty"`
+	Image      string         `json:"image,omitempty"`
+	Step       int            `json:"step,omitempty"`
+	TotalSteps int            `json:"totalSteps,omitempty"`
+	Message    string         `json:"message,omitempty"`
+	Duration   time.Duration  `json:"duration,omitempty"`
+
+	ID             string          `json:"id,omitempty"`
+	Stream         string          `json:"stream,omitempty"`
+	Aux            json.RawMessage `json:"aux,omitempty"`
+	ErrorMessage   string          `json:"error,omitempty"`
+	ProgressDetail *ProgressDetail `json:"progressDetail,omitempty"`
+}
+
+// ProgressDetail mirrors the subset of jsonmessage.JSONProgress that callers
+// actually render (current/total byte counts for a pull/push layer).
+type ProgressDetail struct {
+	Current int64 `json:"current,omitempty"`
+	Total   int64 `json:"total,omitempty"`
+}
+
+// BuildEventSink receives a backend's build/push progress as typed calls
+// instead of a raw jsonmessage stream, so a caller never has to re-parse
+// Docker's JSON itself. sinkBuildEvent is the only place that translates a
+// decoded BuildEvent into these calls, so every backend (and every stream,
+// build or push) goes through the same dispatch.
+type BuildEventSink interface {
+	OnStep(step, total int, cmd string)
+	OnStream(line string)
+	OnAux(imageID, digest string)
+	OnPushProgress(layer string, current, total int64)
+	OnError(err error)
+}
+
+// sinkBuildEvent dispatches a single decoded BuildEvent to sink, translating
+// the grab-bag of optional fields streamBuildEvents decodes a jsonmessage
+// line into onto the typed BuildEventSink calls that line actually means.
+func sinkBuildEvent(sink BuildEventSink, ev BuildEvent) {
+	if sink == nil {
+		return
+	}
+	switch {
+	case ev.ErrorMessage != "":
+		// errors.New, not fmt.Errorf: ev.ErrorMessage comes straight from the
+		// daemon/backend and may itself contain a literal '%', which
+		// fmt.Errorf would otherwise try to interpret as a formatting verb.
+		sink.OnError(errors.New(ev.ErrorMessage))
+	case ev.Kind == BuildEventError:
+		sink.OnError(errors.New(ev.Message))
+	case ev.Kind == BuildEventStep:
+		sink.OnStep(ev.Step, ev.TotalSteps, ev.Message)
+	case ev.ProgressDetail != nil:
+		sink.OnPushProgress(ev.ID, ev.ProgressDetail.Current, ev.ProgressDetail.Total)
+	case ev.Aux != nil:
+		imageID, digest := parseAux(ev.Aux)
+		sink.OnAux(imageID, digest)
+	case ev.Stream != "":
+		sink.OnStream(ev.Stream)
+	case ev.Message != "":
+		sink.OnStream(ev.Message)
+	}
+}
+
+// parseAux picks the fields kindest cares about out of a jsonmessage Aux
+// payload, which for a build is `{"ID":"sha256:..."}` and for a push is
+// `{"Tag":"...","Digest":"sha256:...","Size":...}`.
+func parseAux(raw json.RawMessage) (imageID string, digest string) {
+	var aux struct {
+		ID     string `json:"ID"`
+		Digest string `json:"Digest"`
+	}
+	if err := json.Unmarshal(raw, &aux); err != nil {
+		return "", ""
+	}
+	return aux.ID, aux.Digest
+}
+
+// ttySink renders build/push progress the way kindest always has: error and
+// stream lines written straight through to w.
+type ttySink struct {
+	w io.Writer
+}
+
+// NewTTYSink returns a BuildEventSink that reproduces kindest's classic
+// terminal output, the default when no other sink is configured.
+func NewTTYSink(w io.Writer) BuildEventSink {
+	return &ttySink{w: w}
+}
+
+func (s *ttySink) OnStep(step, total int, cmd string) {
+	fmt.Fprintf(s.w, "Step %d/%d : %s\n", step, total, cmd)
+}
+
+func (s *ttySink) OnStream(line string) {
+	fmt.Fprint(s.w, line)
+}
+
+func (s *ttySink) OnAux(imageID, digest string) {
+	if imageID != "" {
+		fmt.Fprintf(s.w, "Successfully built %s\n", imageID)
+	}
+}
+
+func (s *ttySink) OnPushProgress(layer string, current, total int64) {}
+
+func (s *ttySink) OnError(err error) {
+	fmt.Fprintln(s.w, err.Error())
+}
+
+// jsonLinesSink writes one JSON object per event to w, for a CI log that
+// wants to parse build progress without scraping terminal output.
+type jsonLinesSink struct {
+	w io.Writer
+}
+
+// NewJSONLinesSink returns a BuildEventSink that writes one JSON object per
+// line to w.
+func NewJSONLinesSink(w io.Writer) BuildEventSink {
+	return &jsonLinesSink{w: w}
+}
+
+func (s *jsonLinesSink) emit(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	s.w.Write(b)
+}
+
+func (s *jsonLinesSink) OnStep(step, total int, cmd string) {
+	s.emit(struct {
+		Kind  string `json:"kind"`
+		Step  int    `json:"step"`
+		Total int    `json:"total"`
+		Cmd   string `json:"cmd"`
+	}{"step", step, total, cmd})
+}
+
+func (s *jsonLinesSink) OnStream(line string) {
+	s.emit(struct {
+		Kind string `json:"kind"`
+		Line string `json:"line"`
+	}{"stream", line})
+}
+
+func (s *jsonLinesSink) OnAux(imageID, digest string) {
+	s.emit(struct {
+		Kind    string `json:"kind"`
+		ImageID string `json:"imageId,omitempty"`
+		Digest  string `json:"digest,omitempty"`
+	}{"aux", imageID, digest})
+}
+
+func (s *jsonLinesSink) OnPushProgress(layer string, current, total int64) {
+	s.emit(struct {
+		Kind    string `json:"kind"`
+		Layer   string `json:"layer"`
+		Current int64  `json:"current"`
+		Total   int64  `json:"total"`
+	}{"pushProgress", layer, current, total})
+}
+
+func (s *jsonLinesSink) OnError(err error) {
+	s.emit(struct {
+		Kind  string `json:"kind"`
+		Error string `json:"error"`
+	}{"error", err.Error()})
+}
+
+// channelSink re-serializes each typed call back into a BuildEvent and
+// forwards it onto events, the same non-blocking send emitBuildEvent uses,
+// so a programmatic caller can consume a Builder's output as the same
+// BuildEvent stream it already gets from BuildOptions.Events.
+type channelSink struct {
+	events chan<- BuildEvent
+}
+
+// NewChannelSink returns a BuildEventSink that forwards every call onto
+// events as a BuildEvent, for a caller that wants to consume build/push
+// progress programmatically rather than render it.
+func NewChannelSink(events chan<- BuildEvent) BuildEventSink {
+	return &channelSink{events: events}
+}
+
+func (s *channelSink) send(ev BuildEvent) {
+	select {
+	case s.events <- ev:
+	default:
+	}
+}
+
+func (s *channelSink) OnStep(step, total int, cmd string) {
+	s.send(BuildEvent{Kind: BuildEventStep, Step: step, TotalSteps: total, Message: cmd})
+}
+
+func (s *channelSink) OnStream(line string) {
+	s.send(BuildEvent{Stream: line})
+}
+
+func (s *channelSink) OnAux(imageID, digest string) {
+	aux, err := json.Marshal(struct {
+		ID     string `json:"ID,omitempty"`
+		Digest string `json:"Digest,omitempty"`
+	}{imageID, digest})
+	if err != nil {
+		return
+	}
+	s.send(BuildEvent{Aux: aux})
+}
+
+func (s *channelSink) OnPushProgress(layer string, current, total int64) {
+	s.send(BuildEvent{ID: layer, ProgressDetail: &ProgressDetail{Current: current, Total: total}})
+}
+
+func (s *channelSink) OnError(err error) {
+	s.send(BuildEvent{ErrorMessage: err.Error()})
+}
+
+// streamBuildEvents decodes a JSON message stream (a Docker daemon's
+// response, or a CLI Builder's output adapted by textLinesToJSONStream) once,
+// dispatching each message to events (non-blocking, so a slow or absent
+// consumer can never stall the build) and to sink, replacing the old direct
+// jsonmessage.DisplayJSONMessagesStream-to-stderr pipeline. sink may be nil
+// for a caller that only wants the raw BuildEvents.
+func streamBuildEvents(r io.Reader, events chan<- BuildEvent, sink BuildEventSink) error {
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var event BuildEvent
+		if err := dec.Decode(&event); err != nil {
+			return err
+		}
+		sinkBuildEvent(sink, event)
+		if events != nil {
+			select {
+			case events <- event:
+			default:
+			}
+		}
+		if event.ErrorMessage != "" {
+			return errors.New(event.ErrorMessage)
+		}
+	}
+	return nil
+}
+
+// emitTextEvents dispatches one BuildEvent per line for backends (kaniko,
+// buildah) whose output isn't a jsonmessage stream.
+func emitTextEvents(events chan<- BuildEvent, text string) {
+	if events == nil {
+		return
+	}
+	for _, line := range splitLines(text) {
+		if line == "" {
+			continue
+		}
+		select {
+		case events <- BuildEvent{Stream: line}:
+		default:
+		}
+	}
+}
+
+// emitBuildEvent reports ev on events (non-blocking, same as streamBuildEvents)
+// and to sink (nil-safe, so a caller that hasn't set options.Sink is a no-op
+// here), and always logs it through the package logger with structured
+// fields, so LOG_LEVEL=debug output from NewZapLoggerFromEnv is meaningful
+// even when nothing is listening on events.
+func emitBuildEvent(events chan<- BuildEvent, sink BuildEventSink, ev BuildEvent) {
+	sinkBuildEvent(sink, ev)
+	fields := []zap.Field{zap.String("kind", string(ev.Kind))}
+	if ev.Module != "" {
+		fields = append(fields, zap.String("module", ev.Module))
+	}
+	if ev.Image != "" {
+		fields = append(fields, zap.String("image", ev.Image))
+	}
+	if ev.TotalSteps != 0 {
+		fields = append(fields, zap.Int("step", ev.Step), zap.Int("totalSteps", ev.TotalSteps))
+	}
+	if ev.Duration != 0 {
+		fields = append(fields, zap.Duration("duration", ev.Duration))
+	}
+	if ev.Kind == BuildEventError {
+		log.Error(ev.Message, fields...)
+	} else {
+		log.Debug(ev.Message, fields...)
+	}
+	if events == nil {
+		return
+	}
+	select {
+	case events <- ev:
+	default:
+	}
+}
+
+// replayEventsToRespHandler adapts the deprecated `func(io.ReadCloser) error`
+// BuildEx callback to the new typed BuildEvent stream, by re-serializing
+// each event as a `{"stream": "..."}` JSON line -- the same shape the old
+// callback already scanned out of a Docker daemon's raw response body. It
+// exists so callers that haven't migrated to BuildOptions.Events yet keep
+// working against the buildkit/native backends, which never had a raw
+// daemon stream for them to parse in the first place.
+//
+// TODO(v-next): remove once every in-tree caller has moved to Events.
+func replayEventsToRespHandler(events []BuildEvent, respHandler func(io.ReadCloser) error) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, event := range events {
+		line := event.Stream
+		if line == "" {
+			line = event.Message
+		}
+		if line == "" {
+			continue
+		}
+		msg := struct {
+			Stream string `json:"stream,omitempty"`
+		}{Stream: line}
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+	}
+	return respHandler(ioutil.NopCloser(&buf))
+}
+
+func splitLines(s string) []string {
+	var lines []string
+	start := 0
+	for i, r := range s {
+		if r == '\n' {
+			lines = append(lines, s[start:i])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		lines = append(lines, s[start:])
+	}
+	return lines
+}
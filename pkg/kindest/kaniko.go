@@ -0,0 +1,396 @@
+package kindest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"go.uber.org/zap"
+
+	"github.com/midcontinentcontrols/kindest/pkg/logger"
+)
+
+// configMapChunkSize keeps each ConfigMap comfortably under etcd's 1MiB
+// object limit once the rest of the object's metadata is accounted for.
+const configMapChunkSize = 900 * 1024
+
+// kanikoJobTimeout bounds how long buildKaniko will wait on the Job's Pod to
+// start and the Job itself to finish. Without a deadline, a Pod stuck in
+// ImagePullBackOff or unschedulable, or a Job that never completes, hangs
+// the build forever with no way to cancel.
+const kanikoJobTimeout = 30 * time.Minute
+
+// buildKaniko runs kaniko as a batch/v1.Job instead of exec'ing into a
+// sleeping Pod. The gzipped build context is split across one or more
+// ConfigMaps and reassembled by an init container into an emptyDir that
+// kaniko reads with `--context=dir://`, and docker credentials are mounted
+// from a Secret rather than shelled in via `echo ... > config.json`. This
+// avoids losing the build to a transient apiserver exec hiccup. The Job runs
+// its pod once (BackoffLimit 0, RestartPolicy Never): a failed build is not
+// retried, and waitForJobCompletion reports the first failure.
+func buildKaniko(
+	m *Module,
+	dest string,
+	buildContext []byte,
+	relativeDockerfile string,
+	options *BuildOptions,
+	log logger.Logger,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), kanikoJobTimeout)
+	defer cancel()
+	var kubeconfig string
+	if home := homeDir(); home != "" {
+		kubeconfig = filepath.Join(home, ".kube", "config")
+	}
+	log.Info("Building on-cluster", zap.String("kubeconfig", kubeconfig))
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	namespace := "default"
+	name := "kaniko-" + uuid.New().String()[:8]
+
+	gzipped, err := gzipBytes(buildContext)
+	if err != nil {
+		return err
+	}
+	configMaps, err := createContextConfigMaps(ctx, clientset, namespace, name, gzipped)
+	// createContextConfigMaps may have created and returned some chunks
+	// before hitting the one that failed, so clean those up too instead of
+	// leaking them on every upload error.
+	defer deleteConfigMaps(clientset, namespace, configMaps, log)
+	if err != nil {
+		return fmt.Errorf("failed to upload build context: %v", err)
+	}
+
+	secret, err := createDockerConfigSecret(ctx, clientset, namespace, name)
+	if err != nil {
+		return fmt.Errorf("failed to create docker config secret: %v", err)
+	}
+	defer deleteSecret(clientset, namespace, secret, log)
+
+	command := []string{
+		"/kaniko/executor",
+		"--dockerfile=" + relativeDockerfile,
+		"--context=dir:///workspace",
+	}
+	if options.NoPush {
+		command = append(command, "--no-push")
+	} else {
+		command = append(command, "--destination="+dest)
+	}
+	if m.Spec.Build.Target != "" {
+		command = append(command, "--target="+m.Spec.Build.Target)
+	}
+	for _, buildArg := range m.Spec.Build.BuildArgs {
+		command = append(command, fmt.Sprintf("--build-arg=%s=%s", buildArg.Name, buildArg.Value))
+	}
+
+	job := newKanikoJob(name, namespace, command, configMaps, secret)
+	jobs := clientset.BatchV1().Jobs(namespace)
+	if _, err := jobs.Create(ctx, job, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create kaniko job: %v", err)
+	}
+	defer func() {
+		policy := metav1.DeletePropagationBackground
+		if err := jobs.Delete(context.TODO(), job.Name, metav1.DeleteOptions{
+			PropagationPolicy: &policy,
+		}); err != nil {
+			m.log.Error("failed to delete kaniko job", zap.String("err", err.Error()))
+		}
+	}()
+
+	sink := m.eventSink(options)
+	defer close(sink)
+	return streamJobLogs(ctx, clientset, namespace, job.Name, sink, log)
+}
+
+func gzipBytes(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// createContextConfigMaps splits the gzipped build context into
+// configMapChunkSize-sized pieces (base64-encoded, since ConfigMap
+// BinaryData is itself base64 under the hood) and stores each as its own
+// ConfigMap so no single object risks the etcd size limit.
+func createContextConfigMaps(
+	ctx context.Context,
+	clientset *kubernetes.Clientset,
+	namespace string,
+	jobName string,
+	gzipped []byte,
+) ([]*corev1.ConfigMap, error) {
+	encoded := []byte(base64.StdEncoding.EncodeToString(gzipped))
+	configMaps := clientset.CoreV1().ConfigMaps(namespace)
+	var created []*corev1.ConfigMap
+	for i := 0; i < len(encoded); i += configMapChunkSize {
+		end := i + configMapChunkSize
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("%s-context-%d", jobName, len(created)),
+				Namespace: namespace,
+			},
+			BinaryData: map[string][]byte{
+				"chunk": encoded[i:end],
+			},
+		}
+		result, err := configMaps.Create(ctx, cm, metav1.CreateOptions{})
+		if err != nil {
+			return created, err
+		}
+		created = append(created, result)
+	}
+	return created, nil
+}
+
+func deleteConfigMaps(clientset *kubernetes.Clientset, namespace string, configMaps []*corev1.ConfigMap, log logger.Logger) {
+	client := clientset.CoreV1().ConfigMaps(namespace)
+	for _, cm := range configMaps {
+		if err := client.Delete(context.TODO(), cm.Name, metav1.DeleteOptions{}); err != nil {
+			log.Error("failed to delete context configmap", zap.String("name", cm.Name), zap.String("err", err.Error()))
+		}
+	}
+}
+
+// createDockerConfigSecret replaces the old copyDockerCredential shell trick
+// (`echo '...' > /kaniko/.docker/config.json`) with a proper Secret mounted
+// read-only into the kaniko container.
+func createDockerConfigSecret(ctx context.Context, clientset *kubernetes.Clientset, namespace, jobName string) (*corev1.Secret, error) {
+	home := homeDir()
+	if home == "" {
+		home = "/root"
+	}
+	body, err := ioutil.ReadFile(filepath.Join(home, ".docker", "config.json"))
+	if os.IsNotExist(err) {
+		body = []byte("{}")
+	} else if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      jobName + "-docker-config",
+			Namespace: namespace,
+		},
+		Data: map[string][]byte{
+			"config.json": body,
+		},
+	}
+	return clientset.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+}
+
+func deleteSecret(clientset *kubernetes.Clientset, namespace string, secret *corev1.Secret, log logger.Logger) {
+	if secret == nil {
+		return
+	}
+	if err := clientset.CoreV1().Secrets(namespace).Delete(context.TODO(), secret.Name, metav1.DeleteOptions{}); err != nil {
+		log.Error("failed to delete docker config secret", zap.String("name", secret.Name), zap.String("err", err.Error()))
+	}
+}
+
+func newKanikoJob(
+	name string,
+	namespace string,
+	command []string,
+	configMaps []*corev1.ConfigMap,
+	secret *corev1.Secret,
+) *batchv1.Job {
+	var contextVolumes []corev1.Volume
+	var reassemble []string
+	for i, cm := range configMaps {
+		volumeName := fmt.Sprintf("context-%d", i)
+		contextVolumes = append(contextVolumes, corev1.Volume{
+			Name: volumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: cm.Name},
+				},
+			},
+		})
+		reassemble = append(reassemble, fmt.Sprintf("cat /chunks/%d/chunk >> /workspace/context.tar.gz.b64", i))
+	}
+	reassemble = append(reassemble,
+		"base64 -d /workspace/context.tar.gz.b64 | tar -xzf - -C /workspace",
+		"rm /workspace/context.tar.gz.b64",
+	)
+	var initVolumeMounts []corev1.VolumeMount
+	for i := range configMaps {
+		initVolumeMounts = append(initVolumeMounts, corev1.VolumeMount{
+			Name:      fmt.Sprintf("context-%d", i),
+			MountPath: fmt.Sprintf("/chunks/%d", i),
+		})
+	}
+	initVolumeMounts = append(initVolumeMounts, corev1.VolumeMount{Name: "workspace", MountPath: "/workspace"})
+	backoffLimit := int32(0)
+	volumes := append([]corev1.Volume{
+		{Name: "workspace", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		{
+			Name: "docker-config",
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: secret.Name},
+			},
+		},
+	}, contextVolumes...)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"job-name": name},
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					InitContainers: []corev1.Container{{
+						Name:         "reassemble-context",
+						Image:        "alpine:3.15",
+						Command:      []string{"sh", "-c", joinShellLines(reassemble)},
+						VolumeMounts: initVolumeMounts,
+					}},
+					Containers: []corev1.Container{{
+						Name:    "kaniko",
+						Image:   "gcr.io/kaniko-project/executor:debug",
+						Command: command,
+						VolumeMounts: []corev1.VolumeMount{
+							{Name: "workspace", MountPath: "/workspace"},
+							{Name: "docker-config", MountPath: "/kaniko/.docker", ReadOnly: true},
+						},
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{
+								corev1.ResourceMemory: resource.MustParse("512Mi"),
+							},
+						},
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+func joinShellLines(lines []string) string {
+	var script string
+	for i, line := range lines {
+		if i > 0 {
+			script += " && "
+		}
+		script += line
+	}
+	return script
+}
+
+// streamJobLogs waits for the Job's pod to start and tails its combined
+// container logs through the Pods API, forwarding each line as a
+// BuildEvent. It returns the Job's terminal error, if any, or ctx's error if
+// ctx is canceled or its deadline (kanikoJobTimeout) expires first.
+func streamJobLogs(
+	ctx context.Context,
+	clientset *kubernetes.Clientset,
+	namespace string,
+	jobName string,
+	sink chan<- BuildEvent,
+	log logger.Logger,
+) error {
+	podName, err := waitForJobPod(ctx, jobName, namespace, clientset, log)
+	if err != nil {
+		return err
+	}
+	req := clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{
+		Follow:    true,
+		Container: "kaniko",
+	})
+	stream, err := req.Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		line := scanner.Text()
+		emitTextEvents(sink, line)
+	}
+	return waitForJobCompletion(ctx, jobName, namespace, clientset)
+}
+
+// waitForJobPod polls for the Job's Pod to leave Pending so its logs can be
+// streamed. Unlike waitForPod (used by the old exec-based path), this
+// doesn't need readiness, just a container that's started. It gives up with
+// ctx.Err() if ctx is canceled or expires before a Pod starts (e.g. stuck in
+// ImagePullBackOff or unschedulable) instead of polling forever.
+func waitForJobPod(ctx context.Context, jobName, namespace string, clientset *kubernetes.Clientset, log logger.Logger) (string, error) {
+	for {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "job-name=" + jobName,
+		})
+		if err != nil {
+			return "", err
+		}
+		for _, pod := range pods.Items {
+			if pod.Status.Phase != corev1.PodPending {
+				return pod.Name, nil
+			}
+		}
+		log.Debug("waiting for kaniko job pod to start", zap.String("job", jobName))
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("waiting for kaniko job %s pod to start: %v", jobName, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// waitForJobCompletion polls the Job status until it reports success or
+// failure, since batch/v1.Job has no blocking "wait" API of its own. It
+// gives up with ctx.Err() if ctx is canceled or expires before the Job
+// finishes, instead of polling forever.
+func waitForJobCompletion(ctx context.Context, jobName, namespace string, clientset *kubernetes.Clientset) error {
+	for {
+		job, err := clientset.BatchV1().Jobs(namespace).Get(ctx, jobName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if job.Status.Succeeded > 0 {
+			return nil
+		}
+		if job.Status.Failed > 0 {
+			return fmt.Errorf("kaniko job %s failed", jobName)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for kaniko job %s to complete: %v", jobName, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
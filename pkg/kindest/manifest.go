@@ -0,0 +1,245 @@
+package kindest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+
+	"github.com/docker/docker/client"
+)
+
+// BuildPlanNode is one kindest.yaml in the dependency DAG, along with the
+// content digest ResolveManifest computed for it and whether that digest
+// already matches what's recorded in ~/.kindest/state.json.
+type BuildPlanNode struct {
+	ManifestPath string
+	Image        string
+	Digest       string
+	UpToDate     bool
+	Dependencies []*BuildPlanNode
+}
+
+// BuildPlan is the result of walking a module's dependency graph exactly
+// once, before anything is scheduled into the tunny.Pool, so callers can
+// report "N of M images up-to-date" or (in a future --dry-run mode) list
+// exactly what will rebuild.
+type BuildPlan struct {
+	Root *BuildPlanNode
+}
+
+type buildStateEntry struct {
+	Digest  string `json:"digest"`
+	ImageID string `json:"imageId,omitempty"`
+}
+
+type buildState struct {
+	Entries map[string]*buildStateEntry `json:"entries"`
+}
+
+func stateFilePath() (string, error) {
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(u.HomeDir, ".kindest", "state.json"), nil
+}
+
+func loadBuildState() (*buildState, error) {
+	path, err := stateFilePath()
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &buildState{Entries: map[string]*buildStateEntry{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &buildState{}
+	if err := json.Unmarshal(body, state); err != nil {
+		return nil, err
+	}
+	if state.Entries == nil {
+		state.Entries = map[string]*buildStateEntry{}
+	}
+	return state, nil
+}
+
+func (s *buildState) save() error {
+	path, err := stateFilePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, body, 0644)
+}
+
+func stateKey(manifestPath, image string) string {
+	return manifestPath + "|" + image
+}
+
+// ResolveManifest walks a module's dependency DAG exactly once, computing a
+// stable digest for each node over its resolved Dockerfile bytes, build
+// args, target, and the digests of its own dependencies, and compares each
+// against ~/.kindest/state.json to determine which nodes are already up to
+// date. The walk memoizes by manifest path, so a dependency shared by
+// several siblings is only hashed once. cli is used to confirm a
+// digest-matching node's recorded image still actually exists (locally or in
+// the registry) before trusting it as up to date; it may be nil, in which
+// case a digest match alone is trusted, matching this function's historical
+// behavior for callers with no daemon connection (e.g. a dry-run listing).
+func ResolveManifest(ctx context.Context, options *BuildOptions, cli client.APIClient) (*BuildPlan, error) {
+	state, err := loadBuildState()
+	if err != nil {
+		return nil, err
+	}
+	memo := map[string]*BuildPlanNode{}
+	root, err := resolveManifestNode(ctx, options.File, state, memo, cli)
+	if err != nil {
+		return nil, err
+	}
+	return &BuildPlan{Root: root}, nil
+}
+
+func resolveManifestNode(
+	ctx context.Context,
+	file string,
+	state *buildState,
+	memo map[string]*BuildPlanNode,
+	cli client.APIClient,
+) (*BuildPlanNode, error) {
+	manifestPath, err := locateSpec(file)
+	if err != nil {
+		return nil, err
+	}
+	if node, ok := memo[manifestPath]; ok {
+		return node, nil
+	}
+	spec, _, err := loadSpec(file)
+	if err != nil {
+		return nil, err
+	}
+	rootDir := filepath.Dir(manifestPath)
+	node := &BuildPlanNode{ManifestPath: manifestPath, Image: spec.Build.Name}
+	for _, dep := range spec.Dependencies {
+		depFile := filepath.Clean(filepath.Join(rootDir, dep, "kindest.yaml"))
+		depNode, err := resolveManifestNode(ctx, depFile, state, memo, cli)
+		if err != nil {
+			return nil, fmt.Errorf("dependency '%s': %v", dep, err)
+		}
+		node.Dependencies = append(node.Dependencies, depNode)
+	}
+	digest, err := digestManifestNode(manifestPath, spec, node.Dependencies)
+	if err != nil {
+		return nil, err
+	}
+	node.Digest = digest
+	if entry, ok := state.Entries[stateKey(manifestPath, spec.Build.Name)]; ok {
+		node.UpToDate = entry.Digest == digest && imageStillExists(ctx, cli, entry)
+	}
+	memo[manifestPath] = node
+	return node, nil
+}
+
+// imageStillExists reports whether entry.ImageID can still be resolved
+// (locally or in the registry), so a digest match recorded before a
+// `docker rmi`/`docker system prune` doesn't get trusted as up to date when
+// the image it refers to is actually gone. cli == nil (no daemon connection)
+// or an empty ImageID (an older state.json entry recorded before ImageID was
+// tracked) both fall back to trusting the digest alone.
+func imageStillExists(ctx context.Context, cli client.APIClient, entry *buildStateEntry) bool {
+	if cli == nil || entry.ImageID == "" {
+		return true
+	}
+	_, _, err := cli.ImageInspectWithRaw(ctx, entry.ImageID)
+	return err == nil
+}
+
+// digestManifestNode folds the resolved Dockerfile bytes, the sorted build
+// args, the target stage, the content of the build context tar (after
+// .dockerignore filtering), and the digests of every dependency into one
+// stable digest, so editing a COPY'd source file flips the digest exactly
+// like editing the Dockerfile does.
+func digestManifestNode(manifestPath string, spec *KindestSpec, deps []*BuildPlanNode) (string, error) {
+	h := sha256.New()
+	docker := spec.Build.Docker
+	if docker != nil {
+		dockerfilePath := docker.Dockerfile
+		if dockerfilePath == "" {
+			dockerfilePath = "Dockerfile"
+		}
+		dockerfilePath = filepath.Clean(filepath.Join(filepath.Dir(manifestPath), dockerfilePath))
+		body, err := ioutil.ReadFile(dockerfilePath)
+		if err != nil {
+			return "", err
+		}
+		h.Write(body)
+		h.Write([]byte(docker.Target))
+		args := append([]*DockerBuildArg{}, docker.BuildArgs...)
+		sort.Slice(args, func(i, j int) bool { return args[i].Name < args[j].Name })
+		for _, arg := range args {
+			h.Write([]byte(arg.Name))
+			h.Write([]byte(arg.Value))
+		}
+		if !isRemoteContext(docker.Context) {
+			contextPath := filepath.Clean(filepath.Join(filepath.Dir(manifestPath), docker.Context))
+			relDockerfile, err := resolveDockerfile(manifestPath, docker.Dockerfile, docker.Context)
+			if err != nil {
+				return "", err
+			}
+			excludes, err := dockerIgnoreExcludes(contextPath, relDockerfile)
+			if err != nil {
+				return "", err
+			}
+			tarDigest, err := tarContentDigest(contextPath, excludes)
+			if err != nil {
+				return "", err
+			}
+			h.Write([]byte(tarDigest))
+		}
+	}
+	for _, dep := range deps {
+		h.Write([]byte(dep.Digest))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// emitCachedEvent reports that a dependency was skipped because its digest
+// already matched ~/.kindest/state.json, as a CacheHit BuildEvent whose
+// Stream line starts with "cached:".
+func emitCachedEvent(events chan<- BuildEvent, sink BuildEventSink, node *BuildPlanNode) {
+	emitBuildEvent(events, sink, BuildEvent{
+		Kind:    BuildEventCacheHit,
+		Module:  node.ManifestPath,
+		Image:   node.Image,
+		Message: fmt.Sprintf("%s is up to date (%s)", node.Image, node.Digest),
+		Stream:  fmt.Sprintf("cached: %s is up to date (%s)\n", node.Image, node.Digest),
+	})
+}
+
+// recordBuilt updates ~/.kindest/state.json once a plan node has been
+// (re)built, so the next ResolveManifest call can skip it.
+func recordBuilt(manifestPath, image, digest, imageID string) error {
+	state, err := loadBuildState()
+	if err != nil {
+		return err
+	}
+	state.Entries[stateKey(manifestPath, image)] = &buildStateEntry{
+		Digest:  digest,
+		ImageID: imageID,
+	}
+	return state.save()
+}
@@ -1,9 +1,7 @@
 package kindest
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
 	"context"
 	"encoding/base64"
 	"encoding/json"
@@ -20,15 +18,7 @@ import (
 	"github.com/Jeffail/tunny"
 	dockertypes "github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/jsonmessage"
-	"github.com/docker/docker/pkg/term"
-	"github.com/google/uuid"
 	"github.com/hashicorp/go-multierror"
-	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	restclient "k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 
 	"go.uber.org/zap"
 
@@ -69,12 +59,53 @@ type Module struct {
 	Spec         *KindestSpec
 	Dir          string
 	Dependencies []*Module //
-	status       int32
-	subscribersL sync.Mutex
-	subscribers  []chan<- error
-	err          unsafe.Pointer
-	log          logger.Logger
-	pool         *tunny.Pool
+	status            int32
+	subscribersL      sync.Mutex
+	subscribers       []chan<- error
+	eventSubscribersL sync.Mutex
+	eventSubscribers  []chan<- BuildEvent
+	err               unsafe.Pointer
+	log               logger.Logger
+	pool              *tunny.Pool
+}
+
+// SubscribeEvents registers ch to receive every BuildEvent emitted by this
+// Module's current or next Build call, in addition to whatever was passed
+// via BuildOptions.Events. Sends are non-blocking.
+func (m *Module) SubscribeEvents(ch chan<- BuildEvent) {
+	m.eventSubscribersL.Lock()
+	defer m.eventSubscribersL.Unlock()
+	m.eventSubscribers = append(m.eventSubscribers, ch)
+}
+
+func (m *Module) broadcastEvent(event BuildEvent) {
+	m.eventSubscribersL.Lock()
+	defer m.eventSubscribersL.Unlock()
+	for _, subscriber := range m.eventSubscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// eventSink returns a channel that fans a build's BuildEvents out to
+// options.Events (if set) and to every Module.SubscribeEvents listener. The
+// caller must close the returned channel once the build finishes.
+func (m *Module) eventSink(options *BuildOptions) chan<- BuildEvent {
+	ch := make(chan BuildEvent, 32)
+	go func() {
+		for event := range ch {
+			if options.Events != nil {
+				select {
+				case options.Events <- event:
+				default:
+				}
+			}
+			m.broadcastEvent(event)
+		}
+	}()
+	return ch
 }
 
 var ErrModuleNotCached = fmt.Errorf("module is not cached")
@@ -238,55 +269,6 @@ func addDirToBuildContext(
 	return nil
 }
 
-func createDockerInclude(contextPath string, dockerfilePath string) (gitignore.IgnoreMatcher, error) {
-	f, err := os.Open(dockerfilePath)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	var addedPaths []string
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
-		}
-		if strings.HasPrefix(line, "COPY") || strings.HasPrefix(line, "ADD") {
-			fields := strings.Fields(line)
-			if rel := fields[1]; !strings.HasPrefix(rel, "--from") {
-				abs := filepath.Clean(filepath.Join(contextPath, rel))
-				info, err := os.Stat(abs)
-				if err != nil {
-					return nil, fmt.Errorf("failed to stat %v", abs)
-				}
-				if info.IsDir() && !strings.HasSuffix(rel, "/") {
-					rel += "/"
-				}
-				parts := strings.Split(rel, "/")
-				for i := range parts {
-					var full string
-					for _, other := range parts[:i+1] {
-						full = filepath.Join(full, other)
-					}
-					found := false
-					for _, item := range addedPaths {
-						if item == full {
-							found = true
-							break
-						}
-					}
-					if !found {
-						addedPaths = append(addedPaths, full)
-					}
-				}
-			}
-		}
-	}
-	return gitignore.NewGitIgnoreFromReader(
-		"",
-		bytes.NewBuffer([]byte(strings.Join(addedPaths, "\n"))),
-	), nil
-}
 
 func getRelativeDockerfilePath(contextPath, dockerfilePath string) (string, error) {
 	relativeDockerfile, err := filepath.Rel(contextPath, dockerfilePath)
@@ -320,7 +302,7 @@ func (m *Module) loadBuildContext() (BuildContext, string, gitignore.IgnoreMatch
 	if err != nil {
 		return nil, "", nil, err
 	}
-	include, err := createDockerInclude(contextPath, dockerfilePath)
+	include, err := createDockerInclude(contextPath, dockerfilePath, m.Spec.Build.BuildArgs)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -453,18 +435,13 @@ func buildDocker(
 	if err != nil {
 		return err
 	}
-	termFd, isTerm := term.GetFdInfo(os.Stderr)
-	if err := jsonmessage.DisplayJSONMessagesStream(
-		resp.Body,
-		os.Stderr,
-		termFd,
-		isTerm,
-		nil,
-	); err != nil {
+	sink := m.eventSink(options)
+	defer close(sink)
+	if err := streamBuildEvents(resp.Body, sink, NewTTYSink(os.Stderr)); err != nil {
 		return err
 	}
 	if !options.NoPush {
-		authConfig, err := RegistryAuthFromEnv(dest)
+		authConfig, err := ResolveRegistryAuth(dest)
 		if err != nil {
 			return err
 		}
@@ -487,203 +464,13 @@ func buildDocker(
 		if err != nil {
 			return err
 		}
-		termFd, isTerm := term.GetFdInfo(os.Stderr)
-		if err := jsonmessage.DisplayJSONMessagesStream(
-			resp,
-			os.Stderr,
-			termFd,
-			isTerm,
-			nil,
-		); err != nil {
+		if err := streamBuildEvents(resp, sink, NewTTYSink(os.Stderr)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func copyDockerCredential(
-	client *kubernetes.Clientset,
-	config *restclient.Config,
-	pod *corev1.Pod,
-) error {
-	var dockerconfigjson string
-	home := homeDir()
-	if home == "" {
-		home = "/root"
-	}
-	body, err := ioutil.ReadFile(filepath.Join(home, ".docker", "config.json"))
-	if os.IsNotExist(err) {
-		return nil
-	} else if err != nil {
-		return err
-	}
-	dockerconfigjson = string(body)
-	if err := execInPod(
-		client,
-		config,
-		pod,
-		&corev1.PodExecOptions{
-			Command: []string{
-				"sh",
-				"-c",
-				fmt.Sprintf("echo '%s' > /kaniko/.docker/config.json", dockerconfigjson),
-			},
-			Stdin:  false,
-			Stdout: true,
-			Stderr: true,
-			TTY:    false,
-		},
-		nil,
-		os.Stdout,
-		os.Stderr,
-	); err != nil {
-		return err
-	}
-	return nil
-}
-
-func buildKaniko(
-	m *Module,
-	dest string,
-	buildContext []byte,
-	relativeDockerfile string,
-	options *BuildOptions,
-	log logger.Logger,
-) error {
-	var kubeconfig string
-	if home := homeDir(); home != "" {
-		kubeconfig = filepath.Join(home, ".kube", "config")
-	}
-	log.Info("Building on-cluster", zap.String("kubeconfig", kubeconfig))
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if err != nil {
-		return err
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return err
-	}
-	namespace := "default"
-	// TODO: push secrets
-	pod := &corev1.Pod{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "kaniko-" + uuid.New().String()[:8],
-			Namespace: namespace,
-		},
-		Spec: corev1.PodSpec{
-			RestartPolicy: corev1.RestartPolicyNever,
-			Containers: []corev1.Container{{
-				Name:            "kaniko",
-				Image:           "gcr.io/kaniko-project/executor:debug",
-				ImagePullPolicy: corev1.PullIfNotPresent,
-				Command: []string{
-					"sh",
-					"-c",
-					"tail -f /dev/null",
-				},
-			}},
-		},
-	}
-	pods := clientset.CoreV1().Pods(namespace)
-	if _, err := pods.Create(
-		context.TODO(),
-		pod,
-		metav1.CreateOptions{},
-	); err != nil {
-		return fmt.Errorf("failed to create kaniko pod: %v", err)
-	}
-	defer func() {
-		if err := pods.Delete(
-			context.TODO(),
-			pod.Name,
-			metav1.DeleteOptions{},
-		); err != nil {
-			m.log.Error("failed to delete pod", zap.String("err", err.Error()))
-		}
-	}()
-	if err := waitForPod(pod.Name, pod.Namespace, clientset, log); err != nil {
-		return err
-	}
-	command := []string{
-		"/kaniko/executor",
-		"--dockerfile=" + relativeDockerfile,
-		"--context=tar://stdin",
-	}
-	if options.NoPush {
-		command = append(command, "--no-push")
-	} else {
-		command = append(command, "--destination="+dest)
-	}
-	if m.Spec.Build.Target != "" {
-		command = append(command, "--target="+m.Spec.Build.Target)
-	}
-	for _, buildArg := range m.Spec.Build.BuildArgs {
-		command = append(command, fmt.Sprintf("--build-arg=%s=%s", buildArg.Name, buildArg.Value))
-	}
-
-	// gzip the build context
-	var buf bytes.Buffer
-	zw := gzip.NewWriter(&buf)
-	if n, err := zw.Write(buildContext); err != nil {
-		return err
-	} else if n != len(buildContext) {
-		return fmt.Errorf("wrong num bytes")
-	}
-	if err := zw.Close(); err != nil {
-		return err
-	}
-
-	if err := copyDockerCredential(clientset, config, pod); err != nil {
-		return err
-	}
-	log.Info("Copied docker credentials to pod")
-
-	// Exec build process in pod
-	stdoutBuf := bytes.NewBuffer(nil)
-	stderrBuf := bytes.NewBuffer(nil)
-	err = execInPod(
-		clientset,
-		config,
-		pod,
-		&corev1.PodExecOptions{
-			Command: command,
-			Stdin:   true,
-			Stdout:  true,
-			Stderr:  true,
-			TTY:     false,
-		},
-		bytes.NewReader(buf.Bytes()),
-		stdoutBuf,
-		stderrBuf,
-	)
-	stderr, _ := ioutil.ReadAll(stderrBuf)
-	if len(stderr) > 0 {
-		os.Stderr.Write(stderr)
-	}
-	stdout, _ := ioutil.ReadAll(stdoutBuf)
-	if len(stdout) > 0 {
-		os.Stderr.Write(stdout)
-	}
-	if err != nil {
-		if strings.Contains(err.Error(), "command terminated with exit code 1") {
-			// Retrieve the error message
-			if len(stderr) > 0 {
-				parts := strings.Split(string(stderr), "\n")
-				for i := len(parts) - 1; i >= 0; i-- {
-					line := strings.TrimSpace(parts[i])
-					if line != "" {
-						// This is messy but it's the best way to propogate error messages back up.
-						// TODO: test me under wider range of failure circumstances
-						return fmt.Errorf(line)
-					}
-				}
-			}
-		}
-		return err
-	}
-	return nil
-}
-
 func doBuild(
 	m *Module,
 	buildContext []byte,
@@ -717,6 +504,17 @@ func doBuild(
 		); err != nil {
 			return fmt.Errorf("kaniko: %v", err)
 		}
+	case "buildah":
+		if err := buildBuildah(
+			m,
+			dest,
+			buildContext,
+			relativeDockerfile,
+			options,
+			log,
+		); err != nil {
+			return fmt.Errorf("buildah: %v", err)
+		}
 	default:
 		return fmt.Errorf("unknown builder '%s'", options.Builder)
 	}
@@ -748,6 +546,22 @@ func (m *Module) doBuild(options *BuildOptions) error {
 		m.log.Info("No files changed", zap.String("digest", cachedDigest))
 		return nil
 	}
+	dest := sanitizeImageName(options.Repository, m.Spec.Build.Name, options.Tag)
+	combinedDigest, err := m.combinedDigest(digest)
+	if err != nil {
+		return err
+	}
+	if shouldLookupRemoteBuildCache(options) {
+		if ref, ok, err := options.BuildCache.Lookup(repositoryOnly(dest), combinedDigest); err != nil {
+			return err
+		} else if ok {
+			m.log.Info("Remote build cache hit, retagging", zap.String("ref", ref), zap.String("dest", dest))
+			if err := retagFromCache(ref, dest); err != nil {
+				return err
+			}
+			return m.cacheDigest(digest)
+		}
+	}
 	tar, err := buildContext.Archive()
 	if err != nil {
 		return err
@@ -760,6 +574,11 @@ func (m *Module) doBuild(options *BuildOptions) error {
 	); err != nil {
 		return err
 	}
+	if options.BuildCache != nil && !options.NoPush {
+		if err := options.BuildCache.Store(repositoryOnly(dest), combinedDigest, dest); err != nil {
+			m.log.Error("failed to store remote build cache entry", zap.String("err", err.Error()))
+		}
+	}
 	if err := m.cacheDigest(digest); err != nil {
 		return err
 	}
@@ -0,0 +1,182 @@
+package kindest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"go.uber.org/zap"
+)
+
+// defaultRegistryHost is the key Docker's own config.json uses for the
+// official Docker Hub registry, for image references with no registry
+// hostname of their own (e.g. "myrepo/app:latest").
+const defaultRegistryHost = "https://index.docker.io/v1/"
+
+// dockerConfigFile is the subset of ~/.docker/config.json ResolveRegistryAuth
+// reads: per-registry credential helpers, a default credsStore, and
+// directly-embedded (base64) basic-auth entries.
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuthEntry `json:"auths"`
+	CredHelpers map[string]string                `json:"credHelpers"`
+	CredsStore  string                           `json:"credsStore"`
+}
+
+type dockerConfigAuthEntry struct {
+	Auth string `json:"auth"`
+}
+
+// credHelperOutput is the JSON a `docker-credential-<helper> get` call
+// writes to stdout, per the docker-credential-helpers protocol.
+type credHelperOutput struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// ResolveRegistryAuth resolves credentials for the registry hosting ref the
+// same way the Docker CLI itself does: config.json's credHelpers/credsStore
+// (exec'ing `docker-credential-<helper> get`) first, then a base64 auths[...]
+// .auth entry, and finally DOCKER_USERNAME/DOCKER_PASSWORD for backwards
+// compatibility with RegistryAuthFromEnv. This is what lets a push succeed
+// against ECR, GCR, ACR, or any registry the user has already `docker
+// login`'d to, without laundering credentials through env vars.
+func ResolveRegistryAuth(ref string) (*types.AuthConfig, error) {
+	host := registryHostFromRef(ref)
+	cfg, err := loadDockerConfig()
+	if err != nil {
+		log.Debug("no usable docker config.json", zap.String("err", err.Error()))
+		cfg = &dockerConfigFile{}
+	}
+	helper := cfg.CredHelpers[host]
+	if helper == "" {
+		helper = cfg.CredsStore
+	}
+	if helper != "" {
+		if auth, err := credHelperAuth(helper, host); err != nil {
+			log.Debug("credential helper lookup failed",
+				zap.String("helper", helper),
+				zap.String("host", host),
+				zap.String("err", err.Error()))
+		} else {
+			return auth, nil
+		}
+	}
+	if entry, ok := cfg.Auths[host]; ok && entry.Auth != "" {
+		if auth, err := decodeBasicAuth(entry.Auth); err != nil {
+			log.Debug("failed to decode config.json auth entry", zap.String("host", host), zap.String("err", err.Error()))
+		} else {
+			return auth, nil
+		}
+	}
+	return RegistryAuthFromEnv()
+}
+
+// registryHostFromRef extracts the registry hostname an image reference's
+// auth should be looked up under, mirroring how docker/distribution splits
+// the domain out of a reference: anything before the first "/" counts only
+// if it looks like a host (contains "." or ":", or is "localhost");
+// otherwise the reference has no registry component and belongs to Docker
+// Hub.
+func registryHostFromRef(ref string) string {
+	name := ref
+	if i := strings.IndexByte(ref, '/'); i != -1 {
+		name = ref[:i]
+	} else {
+		return defaultRegistryHost
+	}
+	if name != "localhost" && !strings.ContainsAny(name, ".:") {
+		return defaultRegistryHost
+	}
+	return name
+}
+
+func dockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(".docker", "config.json")
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+func loadDockerConfig() (*dockerConfigFile, error) {
+	body, err := ioutil.ReadFile(dockerConfigPath())
+	if err != nil {
+		return nil, err
+	}
+	cfg := &dockerConfigFile{}
+	if err := json.Unmarshal(body, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// credHelperAuth execs `docker-credential-<helper> get`, writing host to its
+// stdin and decoding the {ServerURL,Username,Secret} JSON it writes back, the
+// same protocol `docker login`/`docker push` use against credsStore/credHelpers.
+func credHelperAuth(helper, host string) (*types.AuthConfig, error) {
+	cmd := exec.Command(fmt.Sprintf("docker-credential-%s", helper), "get")
+	cmd.Stdin = strings.NewReader(host)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s get: %v: %s", helper, err, stderr.String())
+	}
+	out := &credHelperOutput{}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return nil, fmt.Errorf("failed to decode docker-credential-%s output: %v", helper, err)
+	}
+	return &types.AuthConfig{
+		Username:      out.Username,
+		Password:      out.Secret,
+		ServerAddress: out.ServerURL,
+	}, nil
+}
+
+// buildahAuthFile is the containers/auth.json document shape `buildah push
+// --authfile` expects: a registry host keyed to a base64 "user:pass" basic
+// auth entry, the same shape config.json's own auths map uses.
+type buildahAuthFile struct {
+	Auths map[string]dockerConfigAuthEntry `json:"auths"`
+}
+
+// buildahAuthFileJSON marshals auth into a buildahAuthFile keyed by dest's
+// registry host, ready to be written out and handed to `buildah push
+// --authfile`.
+func buildahAuthFileJSON(dest string, auth *types.AuthConfig) ([]byte, error) {
+	host := registryHostFromRef(dest)
+	basicAuth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", auth.Username, auth.Password)))
+	return json.Marshal(&buildahAuthFile{
+		Auths: map[string]dockerConfigAuthEntry{
+			host: {Auth: basicAuth},
+		},
+	})
+}
+
+// decodeBasicAuth decodes a config.json auths[host].auth entry, a base64
+// "username:password" pair.
+func decodeBasicAuth(auth string) (*types.AuthConfig, error) {
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed auth entry")
+	}
+	return &types.AuthConfig{
+		Username: parts[0],
+		Password: parts[1],
+	}, nil
+}